@@ -0,0 +1,26 @@
+package cliexpect
+
+import "strings"
+
+// Buffer holds the data received from the shell until it is consumed by an operation. Writes only
+// ever append. A custom implementation (pooled, bounded, etc.) can be supplied via
+// ShellParam.NewBuffer. It is only accessed while the shell holds its lock
+type Buffer interface {
+	Write(p []byte) (int, error)
+	// String returns all the data written since the last Reset
+	String() string
+	// Reset discards all data
+	Reset()
+	Len() int
+}
+
+// builderBuffer is the default Buffer that preallocates BuffSize bytes each time it is reset
+type builderBuffer struct {
+	strings.Builder
+	size int
+}
+
+func (b *builderBuffer) Reset() {
+	b.Builder.Reset()
+	b.Grow(b.size)
+}
@@ -0,0 +1,42 @@
+package cliexpect_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+type resetCounter struct {
+	bytes.Buffer
+	resets int
+}
+
+func (b *resetCounter) Reset() {
+	b.resets++
+	b.Buffer.Reset()
+}
+
+func TestNewBuffer(t *testing.T) {
+	var buffers []*resetCounter
+	param := cliexpect.ShellParam{NewBuffer: func() cliexpect.Buffer {
+		b := new(resetCounter)
+		buffers = append(buffers, b)
+		return b
+	}}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("test\nrouter#\nnext")
+
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test\n", "router#"}, groups)
+	assert.Len(t, buffers, 1)
+	assert.Equal(t, "\nnext", buffers[0].String())
+	assert.Equal(t, 2, buffers[0].resets) // Once when created, once on consume
+
+	// A clone gets its own buffer
+	sh.CloneConfig(new(writer), new(blockingReader))
+	assert.Len(t, buffers, 2)
+}
@@ -0,0 +1,97 @@
+package cliexpect
+
+import (
+	"io"
+	"time"
+)
+
+// rawChunk is the result of a single read of the shell's Reader by the coalescing read goroutine
+type rawChunk struct {
+	data []byte
+	err  error
+}
+
+// coalescer combines the small chunks of a dribbling Reader when CoalesceWindow is set. It is only
+// used by the reader goroutine
+type coalescer struct {
+	raw     chan rawChunk
+	pending rawChunk      // Remainder of a chunk that didn't fit in the last read
+	stop    chan struct{} // Closed by Reattach to stop reading the old transport
+}
+
+// readRaw loops reading out (the shell's Reader when it was started) for the coalescer until the
+// first error, or stop or the shell's stop channel is closed
+func (s *Shell) readRaw(out io.Reader, raw chan<- rawChunk, stop <-chan struct{}) {
+	buff := make([]byte, readBuffSize)
+	for {
+		n, err := out.Read(buff)
+		chunk := rawChunk{data: append([]byte(nil), buff[:n]...), err: err}
+		select {
+		case raw <- chunk:
+		case <-stop:
+			return
+		case <-s.stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readOut reads the next chunk of data from the shell into buff. With CoalesceWindow set, reads
+// that return less than a full buff are combined with those that follow until buff is full, an
+// error occurs, or the window passes without another read completing. Otherwise it is a single read
+func (s *Shell) readOut(buff []byte) (int, error) {
+	window := s.param.CoalesceWindow
+	if window <= 0 || s.param.SynchronousRead {
+		return s.out.Read(buff)
+	}
+	c := &s.coalesce
+	if c.raw == nil {
+		c.raw = make(chan rawChunk)
+		go s.readRaw(s.out, c.raw, c.stop)
+	}
+
+	chunk := c.pending
+	if chunk.data == nil && chunk.err == nil {
+		select {
+		case chunk = <-c.raw:
+		case <-c.stop:
+			return 0, nil
+		case <-s.stop:
+			return 0, nil
+		}
+	}
+	n := 0
+	var timer *time.Timer
+	for {
+		copied := copy(buff[n:], chunk.data)
+		n += copied
+		if copied < len(chunk.data) {
+			// Full - keep the rest (and any error, which comes after it) for next time
+			c.pending = rawChunk{data: chunk.data[copied:], err: chunk.err}
+			break
+		}
+		c.pending = rawChunk{}
+		if chunk.err != nil {
+			return n, chunk.err
+		}
+		if n == len(buff) {
+			break
+		}
+		if timer == nil {
+			timer = time.NewTimer(window)
+			defer timer.Stop()
+		}
+		select {
+		case chunk = <-c.raw:
+			continue
+		case <-timer.C:
+		case <-c.stop:
+		case <-s.stop:
+		}
+		break
+	}
+	return n, nil
+}
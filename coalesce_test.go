@@ -0,0 +1,71 @@
+package cliexpect_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCounter is a Buffer counting its writes
+type writeCounter struct {
+	bytes.Buffer
+	lock   sync.Mutex
+	writes int
+}
+
+func (b *writeCounter) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	b.writes++
+	b.lock.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *writeCounter) count() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.writes
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	const data = "test\nrouter#"
+	for _, window := range []time.Duration{0, 50 * time.Millisecond} {
+		b := new(writeCounter)
+		param := cliexpect.ShellParam{CoalesceWindow: window, NewBuffer: func() cliexpect.Buffer { return b }}
+		sh := cliexpect.NewWithParam(new(writer), iotest.OneByteReader(strings.NewReader(data)), param)
+		sh.SetPromptRegex(`\S+#`)
+
+		_, groups, err := sh.Retrieve()
+		if err != io.EOF {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, []string{"test\n", "router#"}, groups)
+		if window == 0 {
+			assert.True(t, b.count() >= len(data), "%d writes", b.count())
+		} else {
+			// All the bytes arrive within the window (and then EOF)
+			assert.True(t, b.count() <= 2, "%d writes", b.count())
+		}
+	}
+}
+
+func TestCoalesceWindowFullChunk(t *testing.T) {
+	// A read filling the whole chunk (16KB) isn't held back waiting for more
+	r, w := io.Pipe()
+	param := cliexpect.ShellParam{CoalesceWindow: time.Hour, Timeout: time.Second}
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	sh.SetPromptRegex(`\S+#`)
+	go w.Write([]byte(strings.Repeat("x", 16384-len("\nrouter#")) + "\nrouter#"))
+
+	start := time.Now()
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{strings.Repeat("x", 16384-len("\nrouter#")) + "\n", "router#"}, groups)
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,82 @@
+package cliexpect
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Process is a local command started by StartCommand
+type Process struct {
+	cmd *exec.Cmd
+}
+
+// StartCommand starts the named command with args and returns a new shell driving it along with the
+// Process. The command's stdout and stderr are both read by the shell (unless SeparateStderr is
+// set, in which case stderr is read by ExpectStderr), and the shell sends to its stdin. NOTE: These
+// are plain pipes, not a PTY, so programs that require a terminal may behave differently (ex: not
+// printing a prompt)
+func StartCommand(param ShellParam, name string, args ...string) (*Shell, *Process, error) {
+	// Use our own pipes (instead of StdinPipe, etc.) so the shell owns and closes its ends
+	inR, in, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	out, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		in.Close()
+		return nil, nil, err
+	}
+	errR, errW := out, outW
+	if param.SeparateStderr {
+		if errR, errW, err = os.Pipe(); err != nil {
+			inR.Close()
+			in.Close()
+			out.Close()
+			outW.Close()
+			return nil, nil, err
+		}
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, errW
+	err = cmd.Start()
+	// Only the command keeps its ends open so the shell sees EOF once it exits
+	inR.Close()
+	outW.Close()
+	if errW != outW {
+		errW.Close()
+	}
+	if err != nil {
+		in.Close()
+		out.Close()
+		if errR != out {
+			errR.Close()
+		}
+		return nil, nil, err
+	}
+	sh := NewWithParam(in, out, param)
+	if errR != out {
+		sh.AttachStderr(errR)
+	}
+	return sh, &Process{cmd: cmd}, nil
+}
+
+// Wait waits for the process to exit and returns its exit code, or -1 if it was killed by a signal.
+// A non-zero exit code is not an error. The shell sees EOF on the stream once the process (and any
+// children it started that share its output) exits, so this is typically called after matching the
+// final output
+func (p *Process) Wait() (exitCode int, err error) {
+	if err = p.cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return -1, err
+		}
+	}
+	if status, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus(), nil
+	}
+	if p.cmd.ProcessState.Success() {
+		return 0, nil
+	}
+	return 1, nil
+}
@@ -0,0 +1,54 @@
+package cliexpect_test
+
+import (
+	"io"
+	"os/exec"
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	sh, proc, err := cliexpect.StartCommand(cliexpect.ShellParam{}, "sh", "-c", "read x; echo got $x; echo done; exit 3")
+	assert.NoError(t, err)
+	sh.SetPrompt("done")
+
+	assert.NoError(t, sh.SendLine("hello"))
+	_, groups, err := sh.Retrieve()
+	if err != io.EOF {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"got hello\n", "done"}, groups)
+
+	code, err := proc.Wait()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, code)
+	assert.NoError(t, sh.Close())
+}
+
+func TestStartCommandSeparateStderr(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	param := cliexpect.ShellParam{SeparateStderr: true}
+	sh, proc, err := cliexpect.StartCommand(param, "sh", "-c", "echo oops >&2; echo ok; echo done")
+	assert.NoError(t, err)
+	sh.SetPrompt("done")
+
+	_, groups, err := sh.Retrieve()
+	if err != io.EOF {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"ok\n", "done"}, groups)
+	_, groups, err = sh.ExpectStderr(cliexpect.RegexMatcher(`(\w+)\n`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"oops\n", "oops"}, groups)
+
+	_, err = proc.Wait()
+	assert.NoError(t, err)
+	assert.NoError(t, sh.Close())
+}
@@ -0,0 +1,75 @@
+package cliexpect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// shellConfig is the serialized form of a shell configuration
+type shellConfig struct {
+	ShellParam
+	Prompt             string
+	Anchor             *[2]string `json:",omitempty"`
+	FullIncludesPrompt bool
+	TerminalWidth      int      `json:",omitempty"`
+	Teardown           []string `json:",omitempty"`
+	Filters            []string `json:",omitempty"`
+}
+
+// MarshalConfig returns the configuration of this shell as JSON so it can be saved (ex: as a device
+// profile) and restored with NewFromConfig. This includes the ShellParam options, prompt regex and
+// anchors, FullIncludesPrompt, terminal width, teardown commands, and filters added by name. Since
+// they can't be serialized, transport state and hooks (NewBuffer, observers, sinks, mirror, split
+// func, encoding, error patterns and filters not added by name) are not included
+func (s *Shell) MarshalConfig() ([]byte, error) {
+	s.lock.Lock()
+	s.hookLock.RLock()
+	param := s.param
+	s.hookLock.RUnlock()
+	s.lock.Unlock()
+
+	config := shellConfig{
+		ShellParam:         param,
+		Prompt:             param.prompt,
+		Anchor:             param.anchor,
+		FullIncludesPrompt: !param.excludePrompt,
+		TerminalWidth:      param.termWidth,
+		Teardown:           param.teardown,
+	}
+	for _, f := range param.filters {
+		if f.name != "" {
+			config.Filters = append(config.Filters, f.name)
+		}
+	}
+	return json.Marshal(config)
+}
+
+// NewFromConfig creates a shell using the specified Writer/Reader with a configuration saved by
+// MarshalConfig. An error is returned if the configuration is invalid or names a filter that isn't
+// registered
+func NewFromConfig(in io.Writer, out io.Reader, data []byte) (*Shell, error) {
+	var config shellConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	param := config.ShellParam
+	param.anchor = config.Anchor
+	param.excludePrompt = !config.FullIncludesPrompt
+	param.termWidth = config.TerminalWidth
+	param.teardown = config.Teardown
+	if config.Prompt != "" {
+		param.setPromptRegex(config.Prompt)
+	}
+	filterRegistry.RLock()
+	for _, name := range config.Filters {
+		f, ok := filterRegistry.filters[name]
+		if !ok {
+			filterRegistry.RUnlock()
+			return nil, fmt.Errorf("No filter registered as %q", name)
+		}
+		param.filters = append(param.filters, namedFilter{name: name, f: f})
+	}
+	filterRegistry.RUnlock()
+	return NewWithParam(in, out, param), nil
+}
@@ -0,0 +1,64 @@
+package cliexpect_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalConfig(t *testing.T) {
+	param := cliexpect.ShellParam{Timeout: 5 * time.Second, StrictPrompt: true, HistorySize: 10,
+		NewBuffer: func() cliexpect.Buffer { return new(bytes.Buffer) }}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+[#>]`)
+	sh.SetPromptAnchor(`\n`, ``)
+	sh.SetFullIncludesPrompt(false)
+	sh.RegisterTeardown("exit")
+	assert.NoError(t, sh.AddNamedFilter("crlf"))
+	sh.AddFilter(cliexpect.StripANSI) // Not named, so not saved
+
+	data, err := sh.MarshalConfig()
+	assert.NoError(t, err)
+	var config map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &config))
+	assert.Equal(t, `\S+[#>]`, config["Prompt"])
+	assert.Equal(t, []interface{}{"crlf"}, config["Filters"])
+	assert.Equal(t, float64(5*time.Second), config["Timeout"])
+	assert.Equal(t, true, config["StrictPrompt"])
+
+	// The restored shell behaves the same
+	r, w := io.Pipe()
+	restored, err := cliexpect.NewFromConfig(new(writer), r, data)
+	assert.NoError(t, err)
+	go w.Write([]byte("\x1b[1mtest\x1b[0m\r\nrouter>"))
+	full, groups, err := restored.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "\x1b[1mtest\x1b[0m\n", full) // Includes the anchor
+	assert.Equal(t, []string{"\x1b[1mtest\x1b[0m", "router>"}, groups)
+
+	again, err := restored.MarshalConfig()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(data), string(again))
+}
+
+func TestNewFromConfigErrors(t *testing.T) {
+	_, err := cliexpect.NewFromConfig(new(writer), new(blockingReader), []byte(`{"Filters": ["bogus"]}`))
+	assert.Error(t, err)
+	_, err = cliexpect.NewFromConfig(new(writer), new(blockingReader), []byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestRegisterFilter(t *testing.T) {
+	// The registry is global, so use a name no earlier run (ex: with -count) has registered
+	name := fmt.Sprintf("upper-%d", time.Now().UnixNano())
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	assert.Error(t, sh.AddNamedFilter(name))
+	cliexpect.RegisterFilter(name, bytes.ToUpper)
+	assert.NoError(t, sh.AddNamedFilter(name))
+}
@@ -0,0 +1,52 @@
+package cliexpect
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// promptHandler is a handler registered with RegisterPromptHandler
+type promptHandler struct {
+	prompt  *regexp.Regexp
+	handler func(Match) error
+}
+
+// RegisterPromptHandler registers handler to be called by DispatchNext when the whole prompt
+// retrieved matches promptRe (ex: one handler per CLI mode, or for an unexpected confirmation).
+// Handlers are tried in the order registered and only the first match is called. Like RegexMatcher,
+// it panics if promptRe is invalid
+func (s *Shell) RegisterPromptHandler(promptRe string, handler func(Match) error) {
+	h := promptHandler{prompt: regexp.MustCompile(fmt.Sprintf(`%s\A(?:%s)\z`, matchFmt, promptRe)), handler: handler}
+	s.lock.Lock()
+	// Never append into a backing array possibly shared with a cloned config
+	s.param.handlers = append(s.param.handlers[:len(s.param.handlers):len(s.param.handlers)], h)
+	s.lock.Unlock()
+}
+
+// DispatchNext retrieves through the next prompt and calls the handler registered for it with the
+// Match, returning the handler's error. If no handler's prompt matches, it returns an
+// UnexpectedPromptError with the actual prompt without calling any
+func (s *Shell) DispatchNext() error {
+	start := time.Now()
+	full, groups, err := s.retrieve(0, s.timeout())
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return err
+	}
+	s.lock.Lock()
+	handlers := s.param.handlers
+	s.lock.Unlock()
+
+	for _, h := range handlers {
+		if h.prompt.MatchString(groups[1]) {
+			s.observeExpect(start, true)
+			if handlerErr := h.handler(Match{Full: full, Groups: groups, Body: groups[0], Prompt: groups[1]}); handlerErr != nil {
+				return handlerErr
+			}
+			return err
+		}
+	}
+	s.observeExpect(start, false)
+	return &UnexpectedPromptError{Body: groups[0], Prompt: groups[1]}
+}
@@ -0,0 +1,34 @@
+package cliexpect_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchNext(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+[#>?]`)
+	var handled []string
+	handle := func(name string) func(cliexpect.Match) error {
+		return func(m cliexpect.Match) error {
+			handled = append(handled, name+":"+m.Body)
+			return nil
+		}
+	}
+	sh.RegisterPromptHandler(`\S+\(config\)#`, handle("config"))
+	sh.RegisterPromptHandler(`\S+#`, handle("exec"))
+	// Registered later, so never reached for "router(config)#"
+	sh.RegisterPromptHandler(`router\(config\)#`, handle("never"))
+	confirm := errors.New("Confirmation requested")
+	sh.RegisterPromptHandler(`\[confirm\]\?`, func(cliexpect.Match) error { return confirm })
+
+	sh.FeedForTest("a\nrouter#\nb\nrouter(config)#\nc\n[confirm]?\nd\nrouter>")
+	assert.NoError(t, sh.DispatchNext())
+	assert.NoError(t, sh.DispatchNext())
+	assert.Equal(t, []string{"exec:a\n", "config:\nb\n"}, handled)
+	assert.Equal(t, confirm, sh.DispatchNext())
+	assert.Equal(t, &cliexpect.UnexpectedPromptError{Body: "\nd\n", Prompt: "router>"}, sh.DispatchNext())
+}
@@ -0,0 +1,81 @@
+package cliexpect
+
+import (
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// textDecoder decodes data as it streams through the reader. It keeps an incomplete multi-byte
+// sequence at the end of one read until the next, so characters split across reads decode correctly
+type textDecoder struct {
+	enc     encoding.Encoding // Encoding the transformer was created for
+	t       transform.Transformer
+	pending []byte // Start of a sequence still waiting for the rest of its bytes
+}
+
+// SetEncoding sets the text encoding used by the device (ex: charmap.ISO8859_1 for Latin-1 from
+// golang.org/x/text/encoding/charmap). Data read from then on is decoded to UTF-8 before anything
+// else is done with it (so sinks, filters and matchers all see UTF-8), and data sent by SendBytes
+// and the helpers built on it is encoded from UTF-8, returning an error without sending anything if
+// it has a character the encoding can't represent. SendRaw is never encoded. Nil disables it
+func (s *Shell) SetEncoding(enc encoding.Encoding) {
+	s.hookLock.Lock()
+	s.param.encoding = enc
+	s.hookLock.Unlock()
+}
+
+// currentEncoding returns the encoding set by SetEncoding, if any
+func (s *Shell) currentEncoding() encoding.Encoding {
+	s.hookLock.RLock()
+	defer s.hookLock.RUnlock()
+	return s.param.encoding
+}
+
+// decodeText decodes chunk to UTF-8 if an encoding is set. If final, no more data will be read so any
+// incomplete sequence held back is decoded as well (usually to the replacement character)
+func (s *Shell) decodeText(chunk []byte, final bool) []byte {
+	enc, d := s.currentEncoding(), &s.decode
+	if (enc != nil || d.enc != nil) && !sameValue(enc, d.enc) {
+		// Start over with the new encoding, including any sequence held back for the prior one
+		chunk = append(d.pending, chunk...)
+		d.enc, d.t, d.pending = enc, nil, nil
+		if enc != nil {
+			d.t = enc.NewDecoder()
+		}
+	}
+	if d.t == nil {
+		return chunk
+	}
+
+	src := append(d.pending, chunk...)
+	// No encoding expands a byte to more than a 3 byte UTF-8 character, but loop just in case
+	dst := make([]byte, 3*len(src)+utf8.UTFMax)
+	var out []byte
+	for {
+		nDst, nSrc, err := d.t.Transform(dst, src, final)
+		out = append(out, dst[:nDst]...)
+		src = src[nSrc:]
+		if err == transform.ErrShortDst && (nDst > 0 || nSrc > 0) {
+			continue
+		}
+		if err != nil && err != transform.ErrShortSrc {
+			// Decoders replace invalid data rather than failing, so this should never happen
+			out = append(out, src...)
+			src = nil
+		}
+		break
+	}
+	d.pending = append([]byte(nil), src...)
+	return out
+}
+
+// encodeText encodes b from UTF-8 if an encoding is set
+func (s *Shell) encodeText(b []byte) ([]byte, error) {
+	enc := s.currentEncoding()
+	if enc == nil {
+		return b, nil
+	}
+	return enc.NewEncoder().Bytes(b)
+}
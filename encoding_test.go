@@ -0,0 +1,37 @@
+package cliexpect_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestSetEncoding(t *testing.T) {
+	w := new(writer)
+	r, pw := io.Pipe()
+	sh := cliexpect.New(w, r)
+	sh.SetPromptRegex(`\S+#`)
+	sh.SetEncoding(charmap.ISO8859_1)
+
+	assert.NoError(t, sh.SendLine("café"))
+	assert.Equal(t, []byte("caf\xe9\n"), w.data)
+	assert.Error(t, sh.Send("€"))
+
+	pw.Write([]byte("\nna\xefve\nrouter#"))
+	_, groups, err := sh.Expect(cliexpect.StrMatcher("naïve"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"naïve", "router#"}, groups)
+
+	// A two byte character split across reads
+	sh.SetEncoding(unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM))
+	for _, part := range []string{"\x00\n\x00", "\xe9\x00\n\x00r\x00#"} {
+		pw.Write([]byte(part))
+	}
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\né\n", "r#"}, groups)
+}
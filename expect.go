@@ -3,49 +3,433 @@
 package cliexpect
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/unicode/norm"
 )
 
 const (
 	defaultTimeout  = 10 * time.Second
 	defaultBuffSize = 16384
 	readBuffSize    = defaultBuffSize // Must always be lte size of defaultBuffSize
+	defaultChanSize = 16
+	availablePoll   = 10 * time.Millisecond
+	teardownTimeout = 1 * time.Second
 
 	matchFmt           = `(?ms)`
-	retrieveRegex      = `(.*?)(^%s$)`
+	retrieveRegex      = `(.*?)%s(%s)%s`
+	retrieveEndRegex   = `(.*?)%s(%s)%s\z`  // Prompt must be the very last thing buffered
+	retrieveLastRegex  = `(.*)%s(%s)%s`     // Greedy body ending at the last prompt buffered
+	echoRegex          = `\A(?:%s)[^\n]*\n` // Prompt followed by the echoed command on the first line
+	defaultAnchorStart = `^`
+	defaultAnchorEnd   = `$`
 	defaultPromptRegex = `\S+` // Prompt is one or more chars that are NOT whitespace
+	sentinelPrefix     = "CLIEXPECT-"
+	blankLinesRegex    = `(?:^[ \t\r]*\n){%d}` // Blank lines required before the prompt
 )
 
 // ErrNoMatches represents the error returned when the expected matcher is not matched and
 // the reader returns an error (if it doesn't eventually it just times out)
 var ErrNoMatches = errors.New("No matches")
 
+// TooMuchDataError is returned when more data is buffered than an operation allows before a match
+type TooMuchDataError struct {
+	Buffered, Max int
+}
+
+func (e *TooMuchDataError) Error() string {
+	return fmt.Sprintf("Too much data: %d bytes buffered (max %d)", e.Buffered, e.Max)
+}
+
+// LineTooLongError is returned when the last buffered line grows past MaxLineLength without a newline
+// or match. Prefix holds the first MaxLineLength bytes of the line
+type LineTooLongError struct {
+	Prefix string
+	Max    int
+}
+
+func (e *LineTooLongError) Error() string {
+	return fmt.Sprintf("Line too long: over %d bytes without a newline starting %q", e.Max, e.Prefix)
+}
+
+// PartialMatchError is returned in place of a timeout when EnablePartialMatchDiagnostics is set and
+// the start of what was being waited for was found in the buffered data
+type PartialMatchError struct {
+	Err     error  // Timeout error
+	Offset  int    // Offset in the buffered data where the partial match starts
+	Matched string // Buffered text matching the start of the prompt or delimiter
+	Missing string // Rest of the prompt (as a literal or regex) or delimiter that never arrived
+}
+
+func (e *PartialMatchError) Error() string {
+	return fmt.Sprintf("%v: got as far as %q but never saw %q", e.Err, e.Matched, e.Missing)
+}
+
+// TemplateError is returned by SendTemplate when the template can't be parsed or executed. This
+// allows it to be distinguished from the write errors also returned by SendTemplate
+type TemplateError struct {
+	Err error
+}
+
+func (e *TemplateError) Error() string {
+	return "Template error: " + e.Err.Error()
+}
+
+// CommandError is returned by ExpectOrError when the body matches an error pattern
+type CommandError struct {
+	Text         string // Text matched by the error pattern
+	Body, Prompt string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("Command error: %q", e.Text)
+}
+
+// DisconnectedError is returned by Retrieve and the operations built on it when the reader fails
+// with an error other than EOF (ex: a connection reset) before the prompt is matched. Partial holds
+// all the data buffered at that time, which is left in the buffer
+type DisconnectedError struct {
+	Partial string
+	Err     error // Error from the Reader
+}
+
+func (e *DisconnectedError) Error() string {
+	return "Disconnected: " + e.Err.Error()
+}
+
+// BodyMismatchError is returned by Expect (and the operations built on it) when the prompt is
+// retrieved, but the matcher doesn't match the body. The body is consumed, so it is kept here to see
+// what actually came back. IntoPrompt is true if the matcher would have matched had the prompt been
+// part of the body, which is a common mistake since matchers never see the prompt
+type BodyMismatchError struct {
+	Body, Prompt string
+	IntoPrompt   bool
+}
+
+func (e *BodyMismatchError) Error() string {
+	if e.IntoPrompt {
+		return fmt.Sprintf("Body mismatch: pattern only matches into the prompt %q, but matchers only "+
+			"see the body (match the prompt with the prompt regex or use ReadUntil instead): %q", e.Prompt, e.Body)
+	}
+	return fmt.Sprintf("Body mismatch: %q", e.Body)
+}
+
+// UnexpectedBodyError is returned by ExpectEmptyBody when the body retrieved isn't empty
+type UnexpectedBodyError struct {
+	Body, Prompt string
+}
+
+func (e *UnexpectedBodyError) Error() string {
+	return fmt.Sprintf("Unexpected body: %q", e.Body)
+}
+
+// ForbiddenMatchError is returned by ExpectAbsent when the forbidden pattern is found in the body
+type ForbiddenMatchError struct {
+	Text         string // Text matched by the forbidden pattern
+	Body, Prompt string
+}
+
+func (e *ForbiddenMatchError) Error() string {
+	return fmt.Sprintf("Forbidden match: %q", e.Text)
+}
+
+// UnexpectedPromptError is returned by ExpectPromptIn (and DispatchNext) when the prompt retrieved
+// matches none of those allowed
+type UnexpectedPromptError struct {
+	Body, Prompt string
+}
+
+func (e *UnexpectedPromptError) Error() string {
+	return fmt.Sprintf("Unexpected prompt: %q", e.Prompt)
+}
+
+// SequenceError is returned by ExpectSequence when a step fails. Err is an UnexpectedPromptError with
+// the actual prompt if the wrong prompt was seen, otherwise the retrieve error
+type SequenceError struct {
+	Step     int // Index of the failed step
+	Expected string
+	Err      error
+}
+
+func (e *SequenceError) Error() string {
+	return fmt.Sprintf("Sequence step %d (%q): %v", e.Step, e.Expected, e.Err)
+}
+
+// EachError is returned by ExpectEach when one of the responses fails
+type EachError struct {
+	Index int // Index of the failed response
+	Err   error
+}
+
+func (e *EachError) Error() string {
+	return fmt.Sprintf("Response %d: %v", e.Index, e.Err)
+}
+
+// ErrPromptUnchanged is returned by ExpectPromptChange when the prompt retrieved is the same as the last one
+var ErrPromptUnchanged = errors.New("Prompt unchanged")
+
+// ErrLinesStopped is returned by the func returned by LinesUntilPrompt when it stopped the delivery
+// of lines before the prompt
+var ErrLinesStopped = errors.New("Lines stopped before the prompt")
+
+// ErrBudgetExpired is returned when sending after the budget set by WithBudget is spent
+var ErrBudgetExpired = errors.New("Budget expired")
+
+// ErrTooManyIterations is returned when an operation reads and matches MaxRetrieveIterations times
+// without a match
+var ErrTooManyIterations = errors.New("Too many iterations")
+
+// sentinelSeq makes each sentinel generated by SendLineSentinel unique within the process
+var sentinelSeq uint64
+
+// errTimeout is returned when no data arrives before the timeout expires
+var errTimeout = errors.New("Read timed out")
+
+// NULMode controls the treatment of NUL bytes received from the shell
+type NULMode int
+
+const (
+	// NULPassThrough buffers NUL bytes like any other data (the default)
+	NULPassThrough NULMode = iota
+	// NULStrip silently removes NUL bytes before they are buffered
+	NULStrip
+	// NULError buffers data up to the first NUL byte and then stops the reader with ErrNULByte
+	NULError
+)
+
+// ErrNULByte is the reader error when a NUL byte is received and NULHandling is NULError
+var ErrNULByte = errors.New("NUL byte received")
+
+// AdaptiveTimeout sets the timeout to a multiple of the moving average of how long recent successful
+// retrieves took to match, bounded by Min and Max (each if non-zero). Until the first retrieve
+// succeeds, Timeout is used (still bounded). Operations that take an explicit timeout always use it,
+// but still contribute to the average
+type AdaptiveTimeout struct {
+	Min, Max   time.Duration
+	Multiplier float64
+}
+
+// adaptiveWeight is the weight of each new sample in the moving average of retrieve times
+const adaptiveWeight = 4 // 1/4
+
 // ShellParam defines optional parameters for the expect shell
 type ShellParam struct {
 	Timeout  time.Duration
 	BuffSize int
+	// ChannelSize is the number of completed reads that can be outstanding before the reader blocks
+	// waiting for an operation to acknowledge them. Larger values help with bursty input
+	ChannelSize int
+	// MinBytesBeforeMatch delays matching the prompt in Retrieve (and Expect) until at least this many
+	// bytes are buffered, guarding against a prompt-like early chunk ending the body prematurely. The
+	// tradeoff is latency: a response shorter than this is only matched once the reader reports an
+	// error or the timeout expires, which is then not reported as a timeout if it matches. Zero (the
+	// default) matches as soon as data arrives
+	MinBytesBeforeMatch int
+	// SkipLeadingPrompt skips a bare prompt (one with a blank body) matched by the first Retrieve so it
+	// returns the first meaningful output instead of the empty body before the initial prompt
+	SkipLeadingPrompt bool
+	// PromptConfirmWindow, when non-zero, only accepts a prompt that is the very last thing buffered and
+	// then only once no more data arrives within this window. This ensures a prompt-like line in the
+	// middle of the output isn't mistaken for the real prompt, but adds this much latency to every
+	// successful Retrieve (and Expect)
+	PromptConfirmWindow time.Duration
+	// StrictPrompt only accepts a prompt that is the very last thing buffered, so prompt-like lines in
+	// the body are never mistaken for the real prompt. A response followed by more buffered data (ex:
+	// the start of the next response) won't match until the data ends in a prompt again
+	StrictPrompt bool
+	// NULHandling controls what the reader does with NUL bytes received from the shell
+	NULHandling NULMode
+	// NormalizeUnicode NFC normalizes buffered data before every match along with prompts as they are
+	// set so visually identical text in different normalization forms still matches. Since the whole
+	// buffer is normalized on each read, it adds a per-read cost. Expect matchers are not normalized
+	NormalizeUnicode bool
+	// HistorySize is the number of the most recent sends and retrieves kept for History, which is
+	// useful for diagnosing a failure deep in a long sequence. Zero (the default) disables it
+	HistorySize int
+	// EchoOnPromptLine removes a leading line from every retrieved body that starts with the prompt,
+	// for shells that echo the command on the same line as the prompt (ex: "router# show version"),
+	// so the body starts at the real output. The prompt regex must not match ordinary output (like
+	// the default does) or the first line of output would be removed instead
+	EchoOnPromptLine bool
+	// StrictEmptyBody makes ExpectEmptyBody only accept a body with no data at all instead of one that
+	// is empty or only whitespace (the default)
+	StrictEmptyBody bool
+	// SynchronousRead reads from the shell inside each operation as it needs data instead of in a
+	// background reader goroutine, making reads happen at deterministic points (useful in tests and
+	// simple tools). NOTE: A read can't be interrupted, so a Reader that blocks waits past the
+	// operation timeout. The shell should only be used from one goroutine at a time
+	SynchronousRead bool
+	// NewBuffer, if set, is called once by each new shell to create the Buffer holding received data
+	// instead of the default growable one. A factory is used so cloned shells never share a buffer
+	NewBuffer func() Buffer `json:"-"`
+	// PollInterval, when non-zero, is the minimum time between match attempts once some data has
+	// arrived without matching. This caps CPU usage when a slow stream dribbles in tiny chunks, since
+	// each attempt matches the whole buffer, at the cost of up to this much latency after such data.
+	// It never delays matching data that is already buffered or arrives after nothing was
+	PollInterval time.Duration
+	// MaxRetrieveIterations, when non-zero, limits how many times Retrieve (or any other operation
+	// waiting for data) reads and tries to match before failing with ErrTooManyIterations. This guards
+	// against a stream of tiny chunks that never form a prompt independent of the timeout. Zero (the
+	// default) is unlimited
+	MaxRetrieveIterations int
+	// PostMatchGrace, when non-zero, waits up to this long after a prompt is matched (if nothing is
+	// already buffered after it) and then consumes any line endings or bell characters immediately
+	// following the prompt along with it, so they don't show up at the start of the next body. They
+	// are not part of the result. This adds up to this much latency to every successful Retrieve
+	PostMatchGrace time.Duration
+	// AdaptiveTimeout, when its Multiplier is non-zero, replaces Timeout for operations that don't take
+	// their own timeout with one based on how long recent retrieves took
+	AdaptiveTimeout AdaptiveTimeout
+	// SendExpectDelay, when non-zero, is how long helpers that both send and then read the response
+	// (ExpectRetry, ExpectStable, SendInterrupt, SyncPrompt, AutoDetectPrompt and teardown in Close)
+	// wait after sending before the first read, for devices whose output isn't valid until a moment
+	// after receiving a command. Other operations are not delayed
+	SendExpectDelay time.Duration
+	// LastPromptWins ends the body at the last prompt in the buffer instead of the first, for devices
+	// that print prompt-like lines in the middle of their output. NOTE: If the next response (and its
+	// prompt) has already arrived too, both are retrieved as one body
+	LastPromptWins bool
+	// HighWater, when non-zero, stops the reader from reading the shell once this many bytes are
+	// buffered, until operations consume enough that no more than LowWater remain. The unread data
+	// stays in the transport, applying back-pressure to the sender (ex: a net.Conn). If LowWater isn't
+	// below HighWater, half of HighWater is used. NOTE: HighWater must exceed the largest response
+	// expected, since an operation can't match data the reader has stopped reading
+	HighWater, LowWater int
+	// PromptBlankLines, when non-zero, only matches a prompt preceded by at least this many blank (or
+	// whitespace only) lines, for CLIs that always print one before the prompt. This is a stronger
+	// anchor that keeps prompt-like lines inside the output from matching. The blank lines are
+	// consumed, but are part of neither the body nor the prompt
+	PromptBlankLines int
+	// IgnorePromptCase matches the prompt regex (or literal) case-insensitively, for devices whose
+	// prompt casing varies (ex: hostname capitalization). Only the prompt itself is affected, not the
+	// anchors around it or any body matching
+	IgnorePromptCase bool
+	// MaxLineLength, when non-zero, fails any operation still waiting for a match with a
+	// LineTooLongError once the last buffered line is longer than this with no newline, guarding
+	// against a corrupted stream or binary blob growing the buffer forever without a prompt
+	MaxLineLength int
+	// EnablePartialMatchDiagnostics makes a retrieve (or ReadUntil) that times out look for the longest
+	// start of the prompt (or delimiter) in the buffered data and, if found, return a
+	// PartialMatchError describing how far it got. For a regex prompt, the longest prefix of the regex
+	// that still compiles and matches is used, so this is a heuristic
+	EnablePartialMatchDiagnostics bool
+	// SeparateStderr makes StartCommand attach the command's stderr with AttachStderr instead of
+	// reading it along with stdout. It has no effect on other shells
+	SeparateStderr bool
+	// TrimLeadingNewline removes a single line ending (either "\n" or "\r\n") from the start of every
+	// retrieved body (and the full match), such as the one ending the line of the previous prompt
+	TrimLeadingNewline bool
+	// TrimPromptSpace removes trailing whitespace from every retrieved prompt (including LastPrompt,
+	// but not the full match), so prompts compare equal however the device spaced them
+	TrimPromptSpace bool
+	// KeepaliveInterval, when non-zero, sends KeepaliveData (a newline if empty) whenever an operation
+	// waiting for data sees nothing arrive for this long, so the far end doesn't time out the session
+	// during a long quiet command. Each keepalive is assumed to make the shell print one extra bare
+	// prompt once the real one is done, so that many bare prompts (empty or whitespace only bodies) are
+	// skipped by later retrieves instead of being mistaken for responses. Its echo, if any, stays
+	// in the body
+	KeepaliveInterval time.Duration
+	KeepaliveData     []byte
+	// CoalesceWindow, when non-zero, combines reads that return less than a full chunk (ex: a
+	// transport delivering one byte at a time) with those completing within this window of each
+	// other, so the data is buffered and operations are woken once per chunk instead of once per
+	// read. Reads are done by an extra goroutine, so while paused (or over HighWater) one more chunk
+	// may be read. A read returning a full chunk is never delayed. Not used with SynchronousRead
+	CoalesceWindow time.Duration
+	// SlowMatchThreshold, when non-zero, times every match attempt made while an operation waits for
+	// data and reports any taking at least this long to the observer, if it implements
+	// SlowMatchObserver. Since each attempt matches the whole buffer, this finds matchers that burn
+	// CPU on large outputs (consider PollInterval or TailMatcher for those)
+	SlowMatchThreshold time.Duration
 
-	retrieve Matcher
+	prompt        string
+	promptLit     string // Set only when the prompt is a literal
+	anchor        *[2]string
+	retrieve      Matcher
+	retrieveEnd   Matcher
+	echo          Matcher
+	split         Matcher
+	termWidth     int
+	encoding      encoding.Encoding
+	excludePrompt bool
+	observer      Observer
+	teardown      []string
+	sinks         []io.Writer
+	mirror        io.Writer
+	errorPatterns []Matcher
+	handlers      []promptHandler
+	filters       []namedFilter
+}
+
+// Match holds the results of an expect operation
+type Match struct {
+	Full   string   // Full match (the first value returned by Expect)
+	Groups []string // All match groups (the second value returned by Expect)
+	Body   string   // Entire body retrieved before the prompt
+	Prompt string   // Prompt that was matched
 }
 
 // Shell represents a structure used in expect-like interactions
 type Shell struct {
+	// Moving average of the time taken by successful retrieves in nanoseconds. Only accessed atomically,
+	// and first so it is 64-bit aligned
+	avgRetrieve int64
+
 	// Mandatory parameters
 	in  io.Writer
 	out io.Reader
 
 	// Options parameters
-	param ShellParam
+	param    ShellParam
+	hookLock sync.RWMutex
 
 	// Reader loop vars
-	ch     chan error
-	lock   sync.Mutex
-	buffer strings.Builder
+	ch         chan error
+	lock       sync.Mutex
+	buffer     Buffer
+	eof        bool
+	prompted   bool
+	lastPrompt string
+	received   int // Total bytes ever added to the buffer
+	deadline   time.Time
+	failed     error // Set by Fail
+	keepalives int   // Bare prompts still expected from keepalives
+	stderr     *stderrStream
+	unwrap     unwrapper   // Only used by the reader
+	coalesce   coalescer   // Only used by the reader
+	decode     textDecoder // Only used by the reader
+
+	// Synchronous read vars (only used by the operation doing the read)
+	syncBuff []byte
+	syncErr  error
+
+	// History vars (protected by lock)
+	history     []Operation
+	historyNext int
+
+	// Reader pause and shutdown vars
+	gateLock sync.Mutex
+	gate     *sync.Cond
+	paused   bool
+	full     bool // Buffer reached HighWater
+	detached bool // Set by Reattach while the reader of the old transport stops
+	stopped  bool
+	stop     chan struct{}
+	done     chan struct{}
+	tasks    sync.WaitGroup
 }
 
 // New creates an expect struct using the specified Writer/Reader with default parameters
@@ -61,6 +445,84 @@ func validateParams(param *ShellParam) {
 	if param.Timeout < 1 {
 		param.Timeout = defaultTimeout
 	}
+	if param.ChannelSize < 1 {
+		param.ChannelSize = defaultChanSize
+	}
+	if param.HighWater > 0 && (param.LowWater < 0 || param.LowWater >= param.HighWater) {
+		param.LowWater = param.HighWater / 2
+	}
+	if param.retrieve == nil {
+		param.setPromptRegex(defaultPromptRegex)
+	}
+}
+
+// setPromptRegex builds the matchers used to retrieve the text before the specified prompt regex
+func (p *ShellParam) setPromptRegex(re string) {
+	if p.NormalizeUnicode {
+		re = norm.NFC.String(re)
+	}
+	p.prompt, p.promptLit = re, ""
+	if p.IgnorePromptCase {
+		re = fmt.Sprintf(`(?i:%s)`, re)
+	}
+	before, after := defaultAnchorStart, defaultAnchorEnd
+	if p.anchor != nil {
+		before, after = p.anchor[0], p.anchor[1]
+	}
+	if p.PromptBlankLines > 0 {
+		before = fmt.Sprintf(blankLinesRegex, p.PromptBlankLines) + before
+	}
+	body := retrieveRegex
+	if p.LastPromptWins {
+		body = retrieveLastRegex
+	}
+	p.retrieve = RegexMatcher(fmt.Sprintf(body, before, re, after))
+	p.retrieveEnd = RegexMatcher(fmt.Sprintf(retrieveEndRegex, before, re, after))
+	p.echo = RegexMatcher(fmt.Sprintf(echoRegex, re))
+}
+
+// setPromptLiteral sets the prompt to the literal string. With the default anchors, the prompt is
+// matched by a fast path that avoids running the regex engine on every read
+func (p *ShellParam) setPromptLiteral(lit string) {
+	p.setPromptRegex(fmt.Sprintf(`\Q%s\E`, lit))
+	if (p.anchor != nil && *p.anchor != [2]string{defaultAnchorStart, defaultAnchorEnd}) || lit == "" ||
+		strings.Contains(lit, "\n") || p.LastPromptWins || p.PromptBlankLines > 0 || p.IgnorePromptCase {
+		return
+	}
+	if p.NormalizeUnicode {
+		lit = norm.NFC.String(lit)
+	}
+	p.promptLit = lit
+	p.retrieve, p.retrieveEnd = literalPromptMatcher(lit, false), literalPromptMatcher(lit, true)
+}
+
+// literalPromptMatcher returns the same results as the default retrieve regex (or the end anchored
+// one if atEnd) for the literal prompt lit, which must be non-empty and not contain a newline
+func literalPromptMatcher(lit string, atEnd bool) Matcher {
+	// The prompt must be on its own line just like with the "^" and "$" anchors
+	onLine := func(input string, begin, end int) bool {
+		return (begin == 0 || input[begin-1] == '\n') && (end == len(input) || input[end] == '\n')
+	}
+
+	return func(input string) []int {
+		if atEnd {
+			if begin := len(input) - len(lit); strings.HasSuffix(input, lit) && onLine(input, begin, len(input)) {
+				return []int{0, len(input), 0, begin, begin, len(input)}
+			}
+			return nil
+		}
+		for offset := 0; ; {
+			idx := strings.Index(input[offset:], lit)
+			if idx < 0 {
+				return nil
+			}
+			begin := offset + idx
+			if end := begin + len(lit); onLine(input, begin, end) {
+				return []int{0, end, 0, begin, begin, end}
+			}
+			offset = begin + 1
+		}
+	}
 }
 
 // NewWithParam creates an expect struct using the specified Writer/Reader with the specified parameters
@@ -68,174 +530,2302 @@ func NewWithParam(in io.Writer, out io.Reader, param ShellParam) *Shell {
 	validateParams(&param)
 
 	sh := &Shell{in: in, out: out, param: param}
-	sh.SetPromptRegex(defaultPromptRegex)
-	// We try an size the channel based on expected number of data chunks to fill a size target of minBuffSize
-	chanSize := param.BuffSize / readBuffSize
-	sh.ch = make(chan error, chanSize)
+	if param.NewBuffer != nil {
+		sh.buffer = param.NewBuffer()
+	} else {
+		sh.buffer = &builderBuffer{size: param.BuffSize}
+	}
+	sh.gate = sync.NewCond(&sh.gateLock)
+	sh.stop, sh.done = make(chan struct{}), make(chan struct{})
+	sh.ch = make(chan error, param.ChannelSize)
+	sh.coalesce.stop = make(chan struct{})
 	sh.resetBuff()
-	go sh.reader()
+	if param.SynchronousRead {
+		close(sh.done) // There is no reader to wait for
+	} else {
+		go sh.reader()
+	}
 
 	return sh
 }
 
-// SetPromptRegex sets the underlying prompt regex used to match the end of output in every expect operation
+// Run performs a single interaction without leaving a Shell behind: it creates a Shell on in/out
+// using prompt as the prompt regex, syncs to the prompt with SyncPrompt, sends command, expects the
+// expect regex in its response, and then closes the Shell. Each step waits up to timeout. An error
+// from the interaction takes precedence over one from Close
+func Run(in io.Writer, out io.Reader, prompt, command, expect string, timeout time.Duration) (Match, error) {
+	sh := NewWithParam(in, out, ShellParam{Timeout: timeout})
+	sh.SetPromptRegex(prompt)
+
+	match, err := func() (Match, error) {
+		if _, err := sh.SyncPrompt(timeout); err != nil {
+			return Match{}, err
+		}
+		if err := sh.SendLine(command); err != nil {
+			return Match{}, err
+		}
+		sh.delayAfterSend()
+		return sh.expect(RegexMatcher(expect), 0, timeout)
+	}()
+	if closeErr := sh.Close(); err == nil {
+		err = closeErr
+	}
+	return match, err
+}
+
+// RegisterTeardown adds commands to be sent in order when Close is called, such as those needed to
+// leave config mode and log out cleanly
+func (s *Shell) RegisterTeardown(cmds ...string) {
+	s.lock.Lock()
+	// Never append into a backing array possibly shared with a cloned config
+	s.param.teardown = append(s.param.teardown[:len(s.param.teardown):len(s.param.teardown)], cmds...)
+	s.lock.Unlock()
+}
+
+// RegisterBackgroundTask runs task in its own goroutine alongside the reader, such as one sending
+// a keepalive on an idle session. The stop channel is closed when Close is called, and Close waits
+// for the task to return after closing the transport. A task registered after Close sees stop
+// already closed
+func (s *Shell) RegisterBackgroundTask(task func(stop <-chan struct{})) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		task(s.stop)
+	}()
+}
+
+// Close sends any registered teardown commands, waiting briefly for the prompt after each one,
+// stops the reader, and then closes the Writer and Reader (and any reader attached by AttachStderr)
+// if they implement io.Closer. If the Reader was closed, Close also waits for the reader goroutine
+// to exit (otherwise a read blocked forever would hang Close - call Wait if needed). It always
+// waits for any background tasks to return. Teardown failures don't stop the remaining commands or
+// the close, but the first error encountered is returned
+func (s *Shell) Close() error {
+	s.lock.Lock()
+	cmds, timeout := s.param.teardown, s.param.Timeout
+	if s.failed != nil {
+		cmds = nil
+	}
+	s.lock.Unlock()
+	if timeout > teardownTimeout {
+		timeout = teardownTimeout
+	}
+
+	var firstErr error
+	for _, cmd := range cmds {
+		err := s.SendLine(cmd)
+		if err == nil {
+			s.delayAfterSend()
+			if _, _, err = s.retrieve(0, timeout); err == io.EOF {
+				err = nil
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Teardown command %q failed: %v", cmd, err)
+		}
+	}
+
+	s.stopReader()
+	if err := s.closeTransport(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := s.closeStderr(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if _, ok := s.out.(io.Closer); ok {
+		s.Wait()
+	}
+	s.tasks.Wait()
+	return firstErr
+}
+
+// closeTransport closes the Reader and Writer if they are closers, closing only once if they are the same
+func (s *Shell) closeTransport() error {
+	var err error
+	outCloser, outOK := s.out.(io.Closer)
+	if outOK {
+		err = outCloser.Close()
+	}
+	if inCloser, ok := s.in.(io.Closer); ok && !(outOK && sameValue(inCloser, outCloser)) {
+		if inErr := inCloser.Close(); err == nil {
+			err = inErr
+		}
+	}
+	return err
+}
+
+// sameValue returns true if both values are identical without risking a panic on uncomparable types
+func sameValue(a, b interface{}) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// CloneConfig creates a new expect struct using the specified Writer/Reader with a copy of all the
+// configuration of this one (prompt, parameters, observer, etc.), but none of its buffered data or
+// other runtime state
+func (s *Shell) CloneConfig(in io.Writer, out io.Reader) *Shell {
+	s.lock.Lock()
+	s.hookLock.RLock()
+	param := s.param
+	s.hookLock.RUnlock()
+	s.lock.Unlock()
+
+	return NewWithParam(in, out, param)
+}
+
+// SetPromptRegex sets the underlying prompt regex used to match the end of output in every expect operation.
+// It is safe to call during an operation in another goroutine, which keeps using the prior prompt
 func (s *Shell) SetPromptRegex(re string) {
-	s.param.retrieve = RegexMatcher(fmt.Sprintf(retrieveRegex, re))
+	s.lock.Lock()
+	s.param.setPromptRegex(re)
+	s.lock.Unlock()
+}
+
+// SetPromptAnchor sets the regexes placed immediately before and after the prompt regex when matching
+// the prompt. The default anchors the prompt to a whole line (before = "^" and after = "$"), but this
+// can be changed for prompts that don't sit on their own line (ex: empty strings for no anchoring at
+// all, or a control character that delimits the prompt). Any text matched by the anchors is consumed,
+// but is part of neither the body nor the prompt. It applies to the current and future prompts
+func (s *Shell) SetPromptAnchor(before, after string) {
+	s.lock.Lock()
+	s.param.anchor = &[2]string{before, after}
+	s.param.setPromptRegex(s.param.prompt)
+	s.lock.Unlock()
 }
 
 // SetPrompt sets the underlying prompt to match based on a literal string and is used to match
 // the end of output in every expect operation
 func (s *Shell) SetPrompt(prompt string) {
-	s.SetPromptRegex(fmt.Sprintf(`\Q%s\E`, prompt))
+	s.lock.Lock()
+	s.param.setPromptLiteral(prompt)
+	s.lock.Unlock()
+}
+
+// SetFullIncludesPrompt controls whether the full match (the first return value) of Retrieve and
+// Expect includes the matched prompt text. By default the prompt is included
+func (s *Shell) SetFullIncludesPrompt(include bool) {
+	s.lock.Lock()
+	s.param.excludePrompt = !include
+	s.lock.Unlock()
+}
+
+// SetSplitFunc sets a function that decides where the body and prompt end in the buffered data in
+// place of the prompt regex, for prompt rules a regex can't capture. It returns false if the buffer
+// doesn't yet hold a complete body and prompt, otherwise the prompt is buffered[bodyEnd:promptEnd]
+// and 0 <= bodyEnd <= promptEnd <= len(buffered) must hold. With StrictPrompt or PromptConfirmWindow,
+// a prompt that doesn't end the buffer is not accepted. A nil func restores the prompt regex
+func (s *Shell) SetSplitFunc(split func(buffered string) (bodyEnd, promptEnd int, ok bool)) {
+	var m Matcher
+	if split != nil {
+		m = func(input string) []int {
+			bodyEnd, promptEnd, ok := split(input)
+			if !ok {
+				return nil
+			}
+			return []int{0, promptEnd, 0, bodyEnd, bodyEnd, promptEnd}
+		}
+	}
+	s.lock.Lock()
+	s.param.split = m
+	s.lock.Unlock()
 }
 
-// resetBuff clears buffer and resizes to minBuffSize
+// resetBuff clears buffer (the default buffer is also resized to BuffSize)
 func (s *Shell) resetBuff() {
 	s.buffer.Reset()
-	s.buffer.Grow(s.param.BuffSize)
 }
 
 // reader loops reading data from reader storing data in a strings.Builder and notifying of
 // each operation error outcome via channel
 func (s *Shell) reader() {
+	defer close(s.done)
+
 	buff := make([]byte, readBuffSize, readBuffSize)
 	for {
-		n, err := s.out.Read(buff)
-		if n > 0 {
-			s.lock.Lock()
-			s.buffer.Write(buff[:n])
-			s.lock.Unlock()
+		if !s.waitIfPaused() {
+			return
 		}
+		err := s.readChunk(buff)
 		// Notify that a read operation was completed and the resulting error, if any
-		s.ch <- err
+		select {
+		case s.ch <- err:
+		case <-s.stop:
+			return
+		}
 		if err != nil {
 			return
 		}
 	}
 }
 
-// SendBytes sends a byte slice to the shell
-func (s *Shell) SendBytes(b []byte) error {
-	_, err := s.in.Write(b)
+// readChunk performs a single read into buff and buffers the data after passing it through the sinks
+// and filters. The caller must not hold the lock
+func (s *Shell) readChunk(buff []byte) error {
+	n, err := s.readOut(buff)
+	chunk := s.decodeText(buff[:n], err != nil)
+	if n = len(chunk); n > 0 {
+		n, err = s.handleNUL(chunk, err)
+	}
+	chunk = chunk[:n]
+	if n > 0 {
+		s.writeSinks(chunk)
+	}
+	if chunk = s.unwrapLines(chunk, err != nil); len(chunk) > 0 {
+		chunk = s.applyFilters(chunk)
+	}
+	if len(chunk) > 0 || err == io.EOF {
+		s.lock.Lock()
+		s.buffer.Write(chunk)
+		s.received += len(chunk)
+		s.eof = err == io.EOF
+		s.updateWater()
+		s.lock.Unlock()
+	}
+	if n > 0 {
+		s.observeBytes(0, n)
+	}
 	return err
 }
 
-// Send sends a string to the shell
-func (s *Shell) Send(str string) error {
-	return s.SendBytes([]byte(str))
+// readSync is waitForData for SynchronousRead, reading once in the caller instead of waiting for the
+// reader. Once a read fails, the error is returned again without reading
+func (s *Shell) readSync(timeout time.Duration) (time.Duration, error) {
+	t := time.Now()
+	if s.syncErr != nil {
+		return 0, s.syncErr
+	}
+	s.gateLock.Lock()
+	blocked := s.paused || s.full || s.stopped
+	s.gateLock.Unlock()
+	if blocked {
+		time.Sleep(timeout)
+		return timeout, errTimeout
+	}
+
+	if s.syncBuff == nil {
+		s.syncBuff = make([]byte, readBuffSize, readBuffSize)
+	}
+	s.syncErr = s.readChunk(s.syncBuff)
+	return time.Since(t), s.syncErr
 }
 
-// SendLine sends a string followed by a newline to the shell
-func (s *Shell) SendLine(str string) error {
-	return s.SendBytes([]byte(str + "\n"))
+// handleNUL processes any NUL bytes in the chunk according to NULHandling returning the new
+// length of the chunk and the resulting read error
+func (s *Shell) handleNUL(chunk []byte, err error) (int, error) {
+	switch s.param.NULHandling {
+	case NULStrip:
+		n := 0
+		for _, b := range chunk {
+			if b != 0 {
+				chunk[n] = b
+				n++
+			}
+		}
+		return n, err
+	case NULError:
+		if idx := bytes.IndexByte(chunk, 0); idx >= 0 {
+			return idx, ErrNULByte
+		}
+	}
+	return len(chunk), err
 }
 
-// Retrieve returns all the text before the next prompt. The results returned from this function
-// match those from the Expect function, but assume the text before the prompt is a single match
-// group (the first one)
-func (s *Shell) Retrieve() (string, []string, error) {
+// AtEOF returns true once the reader has reported io.EOF, meaning no further data will arrive. Any
+// data already buffered can still be retrieved
+func (s *Shell) AtEOF() bool {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	return s.eof
+}
 
-	var result []int
-	var timeSpent time.Duration
-
-	// Start by just getting whatever data is in the buffer without waiting
-	data, dur, err := s.read(0)
+// waitIfPaused blocks the reader while it is paused. It returns false if the reader should stop
+func (s *Shell) waitIfPaused() bool {
+	s.gateLock.Lock()
+	defer s.gateLock.Unlock()
+	for (s.paused || s.full) && !s.stopped && !s.detached {
+		s.gate.Wait()
+	}
+	return !s.stopped && !s.detached
+}
 
-	for {
-		result = s.param.retrieve(data)
-		// If we got an error or matches then we are done...
-		if err != nil || len(result) > 0 {
-			break
-		}
-		timeSpent += dur
-		data, dur, err = s.read(s.param.Timeout - timeSpent)
+// updateWater stops the reader once the buffer reaches HighWater and restarts it once no more than
+// LowWater remains. It is always called under lock
+func (s *Shell) updateWater() {
+	if s.param.HighWater <= 0 {
+		return
 	}
-	// If no results then we return early
-	if len(result) < 6 { // Full match + body + prompt
-		if err == nil || err == io.EOF {
-			err = ErrNoMatches
-		}
-		return "", nil, err
+	n := s.buffer.Len()
+	s.gateLock.Lock()
+	resume := s.full && n <= s.param.LowWater
+	if resume {
+		s.full = false
+	} else if n >= s.param.HighWater {
+		s.full = true
 	}
-	// Prepare for the next operation
-	s.resetBuff()
-	// Did we match everything? No, then save that data for next time
-	if result[1] < len(data) {
-		// Write the remaining data back to the buffer
-		s.buffer.WriteString(data[result[1]:])
+	s.gateLock.Unlock()
+	if resume {
+		s.gate.Broadcast()
 	}
-	results := processResults(result, data)
-	return results[0], results[1:], err
 }
 
-// processResults takes the index slice and raw data and converts tem into a slice of matched strings
-func processResults(result []int, data string) []string {
-	subMatchPairs := len(result)
-	matches := make([]string, subMatchPairs/2)
-	for i, j := 0, 0; i < subMatchPairs; i, j = i+2, j+1 {
-		matches[j] = data[result[i]:result[i+1]]
+// stopReader signals the reader to stop at its next opportunity
+func (s *Shell) stopReader() {
+	s.gateLock.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
 	}
-	return matches
+	s.gateLock.Unlock()
+	s.gate.Broadcast()
 }
 
-// Expect takes a matcher and tries to match it against the current data that was received. It returns the
-// entire match, all submatches, and an error, if any occurred.
-func (s *Shell) Expect(m Matcher) (string, []string, error) {
-	full, groups, err := s.Retrieve()
-	if len(groups) < 2 {
-		return "", nil, err
-	}
-	// We base the 2nd match purely on the body we retrieved
-	result := m(groups[0])
-	if len(result) < 2 {
-		if err == nil || err == io.EOF {
-			err = ErrNoMatches
-		}
-		return "", nil, err
-	}
-	results := processResults(result, groups[0])
-	// Add the original prompt matches back onto the results
-	results = append(results, groups[1:]...)
-	return full, results, err
+// Wait blocks until the reader goroutine has exited, after which it never touches the buffer again.
+// The reader exits once the Reader returns an error or, after Close, once its current read returns
+func (s *Shell) Wait() {
+	<-s.done
 }
 
-// ExpectRegex takes a regex as a string, compiles it, and calls Expect looking for matches. The
-// return values are identical to Expect.
-func (s *Shell) ExpectRegex(re string) (string, []string, error) {
-	return s.Expect(RegexMatcher(re))
+// Pause stops the reader from consuming any further data from the shell until Resume is called.
+// Already buffered data is kept and can still be retrieved. A read that is already blocked waiting
+// on the shell when Pause is called completes normally and its data is buffered, however, no new
+// reads are started. Data sent by the shell while paused stays in the transport (OS) buffer
+func (s *Shell) Pause() {
+	s.gateLock.Lock()
+	s.paused = true
+	s.gateLock.Unlock()
 }
 
-// ExpectStr takes a string, converts it to a matcher, and calls Expect looking for matches. The
-// return values are identical to Expect.
-func (s *Shell) ExpectStr(str string) (string, []string, error) {
-	return s.Expect(StrMatcher(str))
+// Resume restarts a reader stopped by Pause
+func (s *Shell) Resume() {
+	s.gateLock.Lock()
+	s.paused = false
+	s.gateLock.Unlock()
+	s.gate.Broadcast()
 }
 
-// read data from the buffer and return it, waiting up to timeout if no data present. In addition
-// to a string of the actual data, the actual duration of time waited is returned
-func (s *Shell) read(timeout time.Duration) (data string, d time.Duration, err error) {
-	var reads int
-	reads, err = ackReads(s.ch)
-	data = s.buffer.String()
+// FeedForTest appends data directly to the buffer as if the reader had read it from the shell. It is
+// intended for testing and for priming the buffer with data that was received by other means
+func (s *Shell) FeedForTest(data string) {
+	s.lock.Lock()
+	io.WriteString(s.buffer, data)
+	s.received += len(data)
+	s.lock.Unlock()
 
-	// Only wait if we have a timeout, no error so far, and then only if we have no data OR we did zero reads
-	if timeout > 0 && err == nil && (data == "" || reads == 0) {
-		d, err = s.waitForData(timeout)
-		data = s.buffer.String()
+	// Wake up any operation waiting on data, but never block if the channel is already full
+	select {
+	case s.ch <- nil:
+	default:
 	}
-	return
 }
 
-// ackReads acknowledges all outstanding read operations done by reader and returns number of
-// channel reads and an error if there is one
-func ackReads(ch chan error) (int, error) {
-	var err error
-	reads := 0
+// Fail puts the shell in a permanent failed state after an unrecoverable condition (ex: the device
+// rebooted mid-session). Every later send and read returns err immediately without any I/O, and any
+// operation waiting for data returns it too, preventing a cascade of confusing timeouts. Only the
+// first error is kept. Close still tears down the transport, but sends no teardown commands
+func (s *Shell) Fail(err error) {
+	s.lock.Lock()
+	if s.failed == nil {
+		s.failed = err
+	}
+	s.lock.Unlock()
+
+	// Wake up any operation waiting on data so it sees the failure
+	select {
+	case s.ch <- nil:
+	default:
+	}
+}
+
+// Failed returns the error passed to Fail, or nil if the shell hasn't failed
+func (s *Shell) Failed() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.failed
+}
+
+// SendBytes sends a byte slice to the shell
+func (s *Shell) SendBytes(b []byte) error {
+	s.lock.Lock()
+	deadline, failed := s.deadline, s.failed
+	s.lock.Unlock()
+	if failed != nil {
+		return failed
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return ErrBudgetExpired
+	}
+
+	encoded, err := s.encodeText(b)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	n, err := s.in.Write(encoded)
+	if n > 0 {
+		s.observeBytes(n, 0)
+	}
+	s.lock.Lock()
+	s.record(Operation{Time: start, Sent: string(b), Err: err})
+	s.lock.Unlock()
+	return err
+}
+
+// SendRaw writes b straight to the shell's writer. It is the low-level escape hatch for sending an
+// exact byte sequence: it skips the budget check, observers, and history that SendBytes and the
+// helpers built on it apply. It still fails once Fail has been called
+func (s *Shell) SendRaw(b []byte) error {
+	if err := s.Failed(); err != nil {
+		return err
+	}
+	_, err := s.in.Write(b)
+	return err
+}
+
+// Send sends a string to the shell
+func (s *Shell) Send(str string) error {
+	return s.SendBytes([]byte(str))
+}
+
+// SendLine sends a string followed by a newline to the shell
+func (s *Shell) SendLine(str string) error {
+	return s.SendBytes([]byte(str + "\n"))
+}
+
+// delayAfterSend waits SendExpectDelay, if any, after a helper sends and before it reads
+func (s *Shell) delayAfterSend() {
+	if delay := s.param.SendExpectDelay; delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// SendTemplate expands tmpl as a text/template using vars (ex: "show interface {{.intf}}") and sends
+// the result followed by a newline. Any template parse or execution error (including a variable
+// missing from vars) is returned as a TemplateError and nothing is sent
+func (s *Shell) SendTemplate(tmpl string, vars map[string]string) error {
+	t, err := template.New("send").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return &TemplateError{Err: err}
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, vars); err != nil {
+		return &TemplateError{Err: err}
+	}
+	return s.SendLine(b.String())
+}
+
+// SendInterrupt sends Ctrl-C (0x03) to abort a running command and then retrieves through the next
+// prompt. Any partial output of the aborted command is consumed and returned as the body of the Match
+func (s *Shell) SendInterrupt() (Match, error) {
+	if err := s.SendBytes([]byte{0x03}); err != nil {
+		return Match{}, err
+	}
+	s.delayAfterSend()
+	start := time.Now()
+	full, groups, err := s.retrieve(0, s.timeout())
+	s.observeExpect(start, groups != nil)
+	if len(groups) < 2 {
+		return Match{}, err
+	}
+	return Match{Full: full, Groups: groups, Body: groups[0], Prompt: groups[1]}, err
+}
+
+// ConfirmYes waits for a confirmation prompt (ex: "Continue? [y/n]:") matching promptRe anywhere in
+// the received data, consumes everything through it, and answers "y". An error is returned if the
+// confirmation prompt doesn't appear
+func (s *Shell) ConfirmYes(promptRe string) error {
+	return s.confirm(promptRe, "y")
+}
+
+// ConfirmNo works like ConfirmYes, but answers "n"
+func (s *Shell) ConfirmNo(promptRe string) error {
+	return s.confirm(promptRe, "n")
+}
+
+// confirm waits for the confirmation prompt and sends the answer
+func (s *Shell) confirm(promptRe, answer string) error {
+	if err := s.waitFor(promptRe); err != nil {
+		return err
+	}
+	return s.SendLine(answer)
+}
+
+// waitFor waits for a match of re anywhere in the received data and consumes everything through it
+func (s *Shell) waitFor(re string) error {
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, result, err := s.readMatch(RegexMatcher(re), 0, 0, s.timeout())
+	s.observeExpect(start, len(result) >= 2)
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return err
+	}
+	s.consume(data, result[1])
+	return nil
+}
+
+// ExpectSkipped waits up to timeout for m to match anywhere in the received data, ignoring prompts,
+// and consumes everything through the match. It returns the data skipped before the match started
+// (ex: a preamble worth logging) along with the match, whose Full is all the data consumed and whose
+// Groups are the match groups as returned by Expect (without a prompt)
+func (s *Shell) ExpectSkipped(m Matcher, timeout time.Duration) (skipped string, match Match, err error) {
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, result, err := s.readMatch(m, 0, 0, timeout)
+	s.observeExpect(start, len(result) >= 2)
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return "", Match{}, err
+	}
+	s.consume(data, result[1])
+	if err == io.EOF {
+		err = nil
+	}
+	return data[:result[0]], Match{Full: data[:result[1]], Groups: processResults(result, data)}, err
+}
+
+// ExpectAny waits up to timeout for any of matchers to match anywhere in the received data, ignoring
+// prompts, returning as soon as one does with its index and a Match like that of ExpectSkipped.
+// Priority is argument order: when more than one matches the data received so far (ex: an error and
+// a success message arriving in the same read), the earliest given wins even if another matches
+// sooner in the data, so list error patterns first. Everything through the winning match is
+// consumed. The index is -1 on failure
+func (s *Shell) ExpectAny(timeout time.Duration, matchers ...Matcher) (int, Match, error) {
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	winner := -1
+	data, result, err := s.readMatch(func(input string) []int {
+		for i, m := range matchers {
+			if result := m(input); len(result) >= 2 {
+				winner = i
+				return result
+			}
+		}
+		return nil
+	}, 0, 0, timeout)
+	s.observeExpect(start, len(result) >= 2)
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return -1, Match{}, err
+	}
+	s.consume(data, result[1])
+	if err == io.EOF {
+		err = nil
+	}
+	return winner, Match{Full: data[:result[1]], Groups: processResults(result, data)}, err
+}
+
+// WithBudget runs fn with a deadline total from now that is shared by every operation on this shell
+// until fn returns. Each operation waits no longer than its own timeout or the remaining budget,
+// whichever is less, and sends fail with ErrBudgetExpired once the budget is spent. Nested budgets
+// can only shorten the deadline. NOTE: The deadline applies to every goroutine using this shell
+func (s *Shell) WithBudget(total time.Duration, fn func(*Shell) error) error {
+	s.lock.Lock()
+	prev := s.deadline
+	if deadline := time.Now().Add(total); prev.IsZero() || deadline.Before(prev) {
+		s.deadline = deadline
+	}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.deadline = prev
+		s.lock.Unlock()
+	}()
+	return fn(s)
+}
+
+// Retrieve returns all the text before the next prompt. The results returned from this function
+// match those from the Expect function, but assume the text before the prompt is a single match
+// group (the first one). If the prompt is already buffered, it returns without any waiting (unless
+// MinBytesBeforeMatch or PromptConfirmWindow require it)
+func (s *Shell) Retrieve() (string, []string, error) {
+	start := time.Now()
+	full, groups, err := s.retrieve(0, s.timeout())
+	s.observeExpect(start, groups != nil)
+	return full, groups, err
+}
+
+// RetrieveLimited works like Retrieve, but returns at most maxBody bytes of the body along with true
+// if it was truncated. The full match is shortened to match. The remainder of the body is still
+// consumed through the prompt and discarded. NOTE: This bounds what is returned, not what is buffered
+// while waiting for the prompt (see ExpectMax for that)
+func (s *Shell) RetrieveLimited(maxBody int) (string, []string, bool, error) {
+	full, groups, err := s.Retrieve()
+	if len(groups) < 2 || len(groups[0]) <= maxBody {
+		return full, groups, false, err
+	}
+	// The body always starts the full match so drop it off the front and replace it
+	full = groups[0][:maxBody] + full[len(groups[0]):]
+	groups[0] = groups[0][:maxBody]
+	return full, groups, true, err
+}
+
+// timeout returns the timeout for operations that don't take their own, adapted to recent retrieve
+// times if AdaptiveTimeout is enabled
+func (s *Shell) timeout() time.Duration {
+	adaptive, timeout := s.param.AdaptiveTimeout, s.param.Timeout
+	if adaptive.Multiplier <= 0 {
+		return timeout
+	}
+	if avg := atomic.LoadInt64(&s.avgRetrieve); avg > 0 {
+		timeout = time.Duration(float64(avg) * adaptive.Multiplier)
+	}
+	if adaptive.Min > 0 && timeout < adaptive.Min {
+		timeout = adaptive.Min
+	}
+	if adaptive.Max > 0 && timeout > adaptive.Max {
+		timeout = adaptive.Max
+	}
+	return timeout
+}
+
+// sampleRetrieve adds the time a successful retrieve took to the moving average. It is always
+// called under lock
+func (s *Shell) sampleRetrieve(d time.Duration) {
+	if d < 1 {
+		d = 1 // Zero means no samples yet
+	}
+	avg := atomic.LoadInt64(&s.avgRetrieve)
+	if avg > 0 {
+		d = time.Duration(avg) + (d-time.Duration(avg))/adaptiveWeight
+	}
+	atomic.StoreInt64(&s.avgRetrieve, int64(d))
+}
+
+// retrieve is the implementation of Retrieve without instrumentation waiting up to timeout. If
+// maxBytes is non-zero, a TooMuchDataError is returned once more than maxBytes are buffered
+func (s *Shell) retrieve(maxBytes int, timeout time.Duration) (string, []string, error) {
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.retrieveLocked(start, maxBytes, timeout)
+}
+
+// retrieveLocked implements retrieve for an operation started at start. It is always called under lock
+func (s *Shell) retrieveLocked(start time.Time, maxBytes int, timeout time.Duration) (string, []string, error) {
+	wait, skipErr := timeout, s.skipKeepalivePrompts()
+	if skipErr != nil {
+		wait = 0 // The reader already failed, so only what is buffered can match
+	}
+	data, result, err := s.readPrompt(maxBytes, wait)
+	if skipErr != nil && (err == nil || err == errTimeout) {
+		err = skipErr
+	}
+	if s.param.SkipLeadingPrompt && !s.prompted && len(result) >= 6 &&
+		strings.TrimSpace(data[result[2]:result[3]]) == "" {
+		// Discard the leading prompt and try again, but don't lose any error it was read with
+		s.consume(data, result[1])
+		prevErr := err
+		data, result, err = s.readPrompt(maxBytes, wait-time.Since(start))
+		if err == nil || (prevErr != nil && err == errTimeout) {
+			err = prevErr
+		}
+	}
+	// If no results then we return early
+	if len(result) < 6 { // Full match + body + prompt
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		} else if isReaderErr(err) && !sameValue(err, s.failed) {
+			err = s.disconnected(data, err)
+		} else if err == errTimeout && s.param.EnablePartialMatchDiagnostics {
+			err = partialOr(s.partialPrompt(data), err)
+		}
+		s.record(Operation{Time: start, Err: err})
+		return "", nil, err
+	}
+	s.prompted = true
+	s.sampleRetrieve(time.Since(start))
+	end := result[1]
+	if s.param.PostMatchGrace > 0 {
+		var graceErr error
+		if data, end, graceErr = s.absorbTrailing(end); err == nil {
+			err = graceErr
+		}
+	}
+	full, groups := s.splitPrompt(data, result)
+	s.lastPrompt = groups[1]
+	s.record(Operation{Time: start, Body: groups[0], Prompt: groups[1], Err: err})
+	s.consume(data, end)
+	if skipErr := s.skipKeepalivePrompts(); skipErr != nil && (err == nil || err == io.EOF) {
+		err = skipErr
+	}
+	return full, groups, err
+}
+
+// partialPrompt finds the longest start of the prompt in data for EnablePartialMatchDiagnostics or
+// returns nil if there is none. It is always called under lock
+func (s *Shell) partialPrompt(data string) *PartialMatchError {
+	if s.param.split != nil {
+		return nil // No prompt to go by
+	}
+	if s.param.promptLit != "" {
+		return partialLiteral(data, s.param.promptLit)
+	}
+	before := defaultAnchorStart
+	if s.param.anchor != nil {
+		before = s.param.anchor[0]
+	}
+	prompt, format := s.param.prompt, "%s%s(?:%s)"
+	if s.param.IgnorePromptCase {
+		format = "%s%s(?i:%s)"
+	}
+	for k := len(prompt) - 1; k > 0; k-- {
+		if !utf8.RuneStart(prompt[k]) {
+			continue
+		}
+		re, err := regexp.Compile(fmt.Sprintf(format, matchFmt, before, prompt[:k]))
+		if err != nil {
+			continue
+		}
+		// Prefer the most recent match since the prompt comes last
+		if locs := re.FindAllStringIndex(data, -1); locs != nil {
+			if loc := locs[len(locs)-1]; loc[1] > loc[0] {
+				return &PartialMatchError{Offset: loc[0], Matched: data[loc[0]:loc[1]], Missing: prompt[k:]}
+			}
+		}
+	}
+	return nil
+}
+
+// partialLiteral finds the last occurrence of the longest prefix of lit in data or returns nil if
+// there is none
+func partialLiteral(data, lit string) *PartialMatchError {
+	for k := len(lit) - 1; k > 0; k-- {
+		if !utf8.RuneStart(lit[k]) {
+			continue
+		}
+		if idx := strings.LastIndex(data, lit[:k]); idx >= 0 {
+			return &PartialMatchError{Offset: idx, Matched: lit[:k], Missing: lit[k:]}
+		}
+	}
+	return nil
+}
+
+// partialOr fills in and returns pm as an error if it isn't nil, otherwise it returns err
+func partialOr(pm *PartialMatchError, err error) error {
+	if pm == nil {
+		return err
+	}
+	pm.Err = err
+	return pm
+}
+
+// absorbTrailing waits up to PostMatchGrace for data after a prompt ending at end if there is none
+// yet, and returns the buffered data along with the new end after any trailing line endings or bell
+// characters. Any error other than a timeout while waiting is returned. It is always called under lock
+func (s *Shell) absorbTrailing(end int) (string, int, error) {
+	data, _, err := s.read(0)
+	if end == len(data) && err == nil {
+		if data, _, err = s.read(s.param.PostMatchGrace); err == errTimeout {
+			err = nil
+		}
+	}
+	for end < len(data) && strings.IndexByte("\r\n\a", data[end]) >= 0 {
+		end++
+	}
+	return data, end, err
+}
+
+// splitPrompt returns the full match and the body and prompt groups from the result of the prompt
+// matcher. It is always called under lock
+func (s *Shell) splitPrompt(data string, result []int) (string, []string) {
+	if s.param.EchoOnPromptLine {
+		// The body begins the full match, so drop the echo line off the front of both
+		if echo := s.param.echo(data[result[2]:result[3]]); len(echo) >= 2 {
+			result[0] += echo[1]
+			result[2] += echo[1]
+		}
+	}
+	if s.param.TrimLeadingNewline {
+		n, body := 0, data[result[2]:result[3]]
+		if strings.HasPrefix(body, "\r\n") {
+			n = 2
+		} else if strings.HasPrefix(body, "\n") {
+			n = 1
+		}
+		result[0] += n
+		result[2] += n
+	}
+	results := processResults(result, data)
+	if s.param.excludePrompt {
+		// Full match ends where the prompt group begins
+		results[0] = data[result[0]:result[4]]
+	}
+	if s.param.TrimPromptSpace {
+		results[2] = strings.TrimRightFunc(results[2], unicode.IsSpace)
+	}
+	return results[0], results[1:]
+}
+
+// TryRetrieve is a dry run of Retrieve: it matches the prompt against the data currently buffered
+// without waiting or consuming anything, returning the Match Retrieve would and true, or false if
+// there is no complete prompt yet. It is useful for debugging a prompt regex that isn't matching.
+// SkipLeadingPrompt and PromptConfirmWindow (beyond requiring the prompt end the buffer) are not applied
+func (s *Shell) TryRetrieve() (Match, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data := s.bufferString()
+	result := s.promptMatcher()(data)
+	if len(result) < 6 {
+		return Match{}, false
+	}
+	full, groups := s.splitPrompt(data, result)
+	return Match{Full: full, Groups: groups, Body: groups[0], Prompt: groups[1]}, true
+}
+
+// ExpectPromptIn retrieves the next prompt and succeeds only if the whole prompt matches one of
+// regexes, returning the index of the first one that does along with the Match. Otherwise, it
+// returns -1 and an UnexpectedPromptError with the actual prompt. This enforces that a scripted flow
+// is in one of the expected states. Like RegexMatcher, it panics if a regex is invalid
+func (s *Shell) ExpectPromptIn(regexes ...string) (int, Match, error) {
+	allowed := make([]*regexp.Regexp, len(regexes))
+	for i, re := range regexes {
+		allowed[i] = regexp.MustCompile(fmt.Sprintf(`%s\A(?:%s)\z`, matchFmt, re))
+	}
+
+	start := time.Now()
+	full, groups, err := s.retrieve(0, s.timeout())
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return -1, Match{}, err
+	}
+	for i, re := range allowed {
+		if re.MatchString(groups[1]) {
+			s.observeExpect(start, true)
+			return i, Match{Full: full, Groups: groups, Body: groups[0], Prompt: groups[1]}, err
+		}
+	}
+	s.observeExpect(start, false)
+	return -1, Match{}, &UnexpectedPromptError{Body: groups[0], Prompt: groups[1]}
+}
+
+// ReturnToPrompt navigates back to a base prompt (ex: leaving nested config modes) by sending exitCmd
+// and retrieving, waiting up to timeout each time, until the whole prompt matches baseRe or maxSteps
+// commands have been sent. It returns the Match of the final step, or an UnexpectedPromptError with
+// the last prompt if the base prompt is never reached. If the last prompt retrieved already matches,
+// nothing is sent and only the Prompt of the Match is set. Like RegexMatcher, it panics if baseRe is
+// invalid
+func (s *Shell) ReturnToPrompt(exitCmd string, baseRe string, maxSteps int, timeout time.Duration) (Match, error) {
+	base := regexp.MustCompile(fmt.Sprintf(`%s\A(?:%s)\z`, matchFmt, baseRe))
+	if last := s.LastPrompt(); last != "" && base.MatchString(last) {
+		return Match{Prompt: last}, nil
+	}
+
+	var match Match
+	for step := 0; step < maxSteps; step++ {
+		if err := s.SendLine(exitCmd); err != nil {
+			return Match{}, err
+		}
+		s.delayAfterSend()
+		start := time.Now()
+		full, groups, err := s.retrieve(0, timeout)
+		if len(groups) < 2 {
+			s.observeExpect(start, false)
+			return Match{}, err
+		}
+		match = Match{Full: full, Groups: groups, Body: groups[0], Prompt: groups[1]}
+		matched := base.MatchString(match.Prompt)
+		s.observeExpect(start, matched)
+		if matched {
+			if err == io.EOF {
+				err = nil
+			}
+			return match, err
+		}
+		if err != nil {
+			return Match{}, err
+		}
+	}
+	return Match{}, &UnexpectedPromptError{Body: match.Body, Prompt: match.Prompt}
+}
+
+// disconnected returns err as a DisconnectedError with the data buffered if it came from a failed
+// read, unless it is the error the shell was failed with. It is always called under lock
+func (s *Shell) disconnected(data string, err error) error {
+	if err != nil && isReaderErr(err) && !sameValue(err, s.failed) {
+		return &DisconnectedError{Partial: data, Err: err}
+	}
+	return err
+}
+
+// isTimeout returns true if err is a timeout, including one reported as a PartialMatchError
+func isTimeout(err error) bool {
+	if pm, ok := err.(*PartialMatchError); ok {
+		err = pm.Err
+	}
+	return err == errTimeout
+}
+
+// isReaderErr returns true if err came from a failed read instead of from the read loop itself, and
+// isn't an orderly end of the stream
+func isReaderErr(err error) bool {
+	switch err.(type) {
+	case *TooMuchDataError, *LineTooLongError:
+		return false
+	}
+	return err != errTimeout && err != io.EOF && err != ErrNULByte && err != ErrTooManyIterations
+}
+
+// ExpectSequence retrieves once per prompt regex, in order, requiring each retrieved prompt to match
+// the whole regex (see ExpectPromptIn), such as when passing through a known series of modes. It
+// returns the Match of each step. On the first failed step, it returns the matches before it and a
+// SequenceError identifying the step
+func (s *Shell) ExpectSequence(prompts ...string) ([]Match, error) {
+	matches := make([]Match, 0, len(prompts))
+	for i, prompt := range prompts {
+		_, match, err := s.ExpectPromptIn(prompt)
+		if match.Groups == nil {
+			return matches, &SequenceError{Step: i, Expected: prompt, Err: err}
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
+// ReconfigurePrompt sets the prompt regex like SetPromptRegex and, without letting any other
+// operation in between, retrieves through the first occurrence of the new prompt waiting up to
+// timeout. Any data still delimited by the old prompt (ex: the response to the command that changed
+// the prompt) becomes the body of the returned Match instead of confusing the next operation. The new
+// prompt stays set even if it isn't found, in which case the buffer is left intact
+func (s *Shell) ReconfigurePrompt(newRegex string, timeout time.Duration) (Match, error) {
+	start := time.Now()
+	s.lock.Lock()
+	s.param.setPromptRegex(newRegex)
+	full, groups, err := s.retrieveLocked(start, 0, timeout)
+	s.lock.Unlock()
+	s.observeExpect(start, groups != nil)
+	if len(groups) < 2 {
+		return Match{}, err
+	}
+	return Match{Full: full, Groups: groups, Body: groups[0], Prompt: groups[1]}, err
+}
+
+// LastPrompt returns the prompt matched by the most recent successful retrieve (by any operation that
+// retrieves up to a prompt such as Retrieve or Expect), or an empty string if none has yet
+func (s *Shell) LastPrompt() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastPrompt
+}
+
+// ExpectPromptChange retrieves the next prompt waiting up to timeout and compares it to the prompt
+// matched by the prior operation, returning both. It returns ErrPromptUnchanged if they are the same,
+// which makes it easy to verify a mode transition (ex: router# to router(config)#)
+func (s *Shell) ExpectPromptChange(timeout time.Duration) (oldPrompt, newPrompt string, err error) {
+	start := time.Now()
+	s.lock.Lock()
+	oldPrompt = s.lastPrompt
+	s.lock.Unlock()
+
+	_, groups, err := s.retrieve(0, timeout)
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return oldPrompt, "", err
+	}
+	newPrompt = groups[1]
+	s.observeExpect(start, newPrompt != oldPrompt)
+	if newPrompt == oldPrompt {
+		return oldPrompt, newPrompt, ErrPromptUnchanged
+	}
+	return oldPrompt, newPrompt, err
+}
+
+// ExpectLine returns the next newline terminated line in the buffer without the line ending (either
+// "\n" or "\r\n"). Once the reader has reported EOF, any remaining data is returned as the final line
+func (s *Shell) ExpectLine() (string, error) {
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, result, err := s.readMatch(s.lineMatcher, 0, 0, s.timeout())
+	s.observeExpect(start, len(result) >= 2)
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return "", err
+	}
+	s.consume(data, result[1])
+	return strings.TrimSuffix(strings.TrimSuffix(data[:result[1]], "\n"), "\r"), err
+}
+
+// ReadUntil returns all the data before the next occurrence of delim, waiting up to timeout for it
+// to arrive. Both the data and the delimiter are consumed
+func (s *Shell) ReadUntil(delim string, timeout time.Duration) (string, error) {
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, result, err := s.readMatch(func(input string) []int {
+		if idx := strings.Index(input, delim); idx >= 0 {
+			return []int{idx, idx + len(delim)}
+		}
+		return nil
+	}, 0, 0, timeout)
+	s.observeExpect(start, len(result) >= 2)
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		} else if err == errTimeout && s.param.EnablePartialMatchDiagnostics {
+			err = partialOr(partialLiteral(data, delim), err)
+		}
+		return "", err
+	}
+	s.consume(data, result[1])
+	return data[:result[0]], err
+}
+
+// ExpectTo streams the body before the next prompt matching promptRe to w instead of returning it,
+// waiting up to timeout for the prompt, so a huge output never has to be held in memory. Each
+// complete line is written and consumed as soon as it arrives, while the last partial line is held
+// back since it may turn out to be the prompt, which must be on its own line. The prompt itself is
+// consumed but not written. On failure, everything streamed so far stays consumed. Like
+// RegexMatcher, it panics if promptRe is invalid
+func (s *Shell) ExpectTo(w io.Writer, promptRe string, timeout time.Duration) error {
+	m := RegexMatcher(fmt.Sprintf(retrieveRegex, defaultAnchorStart, promptRe, defaultAnchorEnd))
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.deadline.IsZero() {
+		if remaining := time.Until(s.deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	data, _, err := s.read(0)
+	for {
+		if s.failed != nil {
+			s.observeExpect(start, false)
+			return s.failed
+		}
+		if result := m(data); len(result) >= 6 {
+			s.observeExpect(start, true)
+			s.lastPrompt = data[result[4]:result[5]]
+			_, writeErr := io.WriteString(w, data[:result[3]])
+			s.consume(data, result[1])
+			if writeErr != nil {
+				return writeErr
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		}
+		if idx := strings.LastIndexByte(data, '\n'); idx >= 0 {
+			_, writeErr := io.WriteString(w, data[:idx+1])
+			s.consume(data, idx+1)
+			if writeErr != nil {
+				s.observeExpect(start, false)
+				return writeErr
+			}
+		}
+		if err == nil && s.eof {
+			err = io.EOF
+		}
+		if err == nil {
+			err = s.checkLineLength(s.bufferString())
+		}
+		if err == nil && time.Since(start) >= timeout {
+			err = errTimeout
+		}
+		if err != nil {
+			s.observeExpect(start, false)
+			if err == io.EOF {
+				err = ErrNoMatches
+			}
+			return err
+		}
+		data, _, err = s.read(timeout - time.Since(start))
+	}
+}
+
+// LinesUntilPrompt delivers the lines of the next body on the returned channel as they arrive,
+// closing it once the prompt is matched and consumed, leaving the buffer positioned after the prompt
+// just like Retrieve. The lines are split as described by ExpectLines, so a final partial line
+// before the prompt is delivered and the prompt line itself never is. The returned func stops the
+// delivery if it is still going (ex: after breaking out of a loop over the channel) without
+// interrupting a read in progress, waits for the channel to close and returns the error that ended
+// it, if any, just like Retrieve would (ex: a timeout or a DisconnectedError). Once stopped,
+// ErrLinesStopped is returned and the lines not yet delivered stay buffered. It must be called
+// before any other operation, except Close, which also stops an abandoned delivery. NOTE: Complete
+// lines are consumed as they arrive, so a prompt regex or anchor spanning more than one line never
+// matches, and PromptBlankLines is rejected with an error
+func (s *Shell) LinesUntilPrompt() (<-chan string, func() error) {
+	ch, stop, done := make(chan string), make(chan struct{}), make(chan struct{})
+	var err error
+	var once sync.Once
+	finish := func() error {
+		once.Do(func() { close(stop) })
+		<-done
+		return err
+	}
+
+	s.lock.Lock()
+	if err = s.failed; err == nil && s.param.PromptBlankLines > 0 {
+		err = errors.New("LinesUntilPrompt can't be used with PromptBlankLines")
+	}
+	if err != nil {
+		s.lock.Unlock()
+		close(ch)
+		close(done)
+		return ch, finish
+	}
+	go func() {
+		defer close(done)
+		err = s.linesUntilPrompt(ch, stop)
+	}()
+	return ch, finish
+}
+
+// linesUntilPrompt implements LinesUntilPrompt, closing ch when done or once stop or the shell's
+// stop channel is closed. It is started under lock, which it releases while waiting to deliver each
+// line and when done
+func (s *Shell) linesUntilPrompt(ch chan<- string, stop <-chan struct{}) error {
+	defer close(ch)
+	defer s.lock.Unlock()
+
+	start, timeout, lead := time.Now(), s.timeout(), true
+	if !s.deadline.IsZero() {
+		if remaining := time.Until(s.deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	// emit delivers the lines of data[begin:end], returning the offset in data just past the last line
+	// delivered if stopped first, or -1. The lock is released while delivering, but since no other
+	// operation can run, the buffer can only grow so data stays a prefix of it
+	emit := func(data string, begin, end int) int {
+		text := data[begin:end]
+		if lead {
+			for _, prefix := range []string{"\r", "\n"} {
+				if strings.HasPrefix(text, prefix) {
+					text, begin = text[len(prefix):], begin+len(prefix)
+				}
+			}
+			lead = false
+		}
+		text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+		if text == "" {
+			return -1
+		}
+		s.lock.Unlock()
+		defer s.lock.Lock()
+		for _, line := range strings.Split(text, "\n") {
+			select {
+			case ch <- strings.TrimSuffix(line, "\r"):
+				begin += len(line) + 1
+			case <-stop:
+				return begin
+			case <-s.stop:
+				return begin
+			}
+		}
+		return -1
+	}
+	// stopped consumes the lines delivered before being stopped at offset at, leaving the rest buffered
+	stopped := func(at int) error {
+		s.consume(s.bufferString(), at)
+		s.observeExpect(start, false)
+		s.record(Operation{Time: start, Err: ErrLinesStopped})
+		return ErrLinesStopped
+	}
+
+	m := s.promptMatcher()
+	data, _, err := s.read(0)
+	for {
+		if s.failed != nil {
+			err = s.failed
+			break
+		}
+		if result := m(data); len(result) >= 6 {
+			_, groups := s.splitPrompt(data, result)
+			if at := emit(data, result[2], result[3]); at >= 0 {
+				return stopped(at)
+			}
+			s.observeExpect(start, true)
+			s.prompted = true
+			s.lastPrompt = groups[1]
+			s.record(Operation{Time: start, Body: groups[0], Prompt: groups[1], Err: err})
+			s.consume(s.bufferString(), result[1])
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		}
+		if idx := strings.LastIndexByte(data, '\n'); idx >= 0 {
+			if at := emit(data, 0, idx+1); at >= 0 {
+				return stopped(at)
+			}
+			s.consume(s.bufferString(), idx+1)
+			data = s.bufferString()
+		}
+		if err == nil && s.eof {
+			err = io.EOF
+		}
+		if err == nil {
+			err = s.checkLineLength(data)
+		}
+		if err == nil && time.Since(start) >= timeout {
+			err = errTimeout
+		}
+		if err != nil {
+			break
+		}
+		data, _, err = s.read(timeout - time.Since(start))
+	}
+	s.observeExpect(start, false)
+	if err == io.EOF {
+		err = ErrNoMatches
+	}
+	err = s.disconnected(data, err)
+	s.record(Operation{Time: start, Err: err})
+	return err
+}
+
+// SendLineSentinel sends cmd followed by a command echoing a newly generated marker, which is
+// returned so ExpectSentinel can wait for it. Since the marker only appears once the command has
+// finished, it bounds the output reliably even if it contains prompt-like lines. The marker is
+// split by empty quotes in the sent line so the echo of the command line itself never matches. It
+// assumes a POSIX style shell where commands are separated by ";"
+func (s *Shell) SendLineSentinel(cmd string) (sentinel string, err error) {
+	id := fmt.Sprintf("%x-%x", time.Now().UnixNano(), atomic.AddUint64(&sentinelSeq, 1))
+	sentinel = sentinelPrefix + id
+	return sentinel, s.SendLine(fmt.Sprintf(`%s; echo %s""%s`, cmd, sentinelPrefix, id))
+}
+
+// ExpectSentinel waits for a line consisting of only the sentinel returned by SendLineSentinel,
+// consuming everything through it. The Body (and only group) of the Match is all the output before
+// the sentinel line, and the Prompt is empty. The prompt that follows the sentinel is left buffered
+func (s *Shell) ExpectSentinel(sentinel string) (Match, error) {
+	re := regexp.MustCompile(fmt.Sprintf(`(?m)^\Q%s\E\r?\n`, sentinel))
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, result, err := s.readMatch(re.FindStringIndex, 0, 0, s.timeout())
+	s.observeExpect(start, len(result) >= 2)
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return Match{}, err
+	}
+	s.consume(data, result[1])
+	body := data[:result[0]]
+	return Match{Full: data[:result[1]], Groups: []string{body}, Body: body}, err
+}
+
+// ReadN waits up to timeout for at least n bytes to be buffered and then consumes and returns exactly
+// n bytes, leaving the rest buffered. A negative n is an error
+func (s *Shell) ReadN(n int, timeout time.Duration) (string, error) {
+	if n < 0 {
+		return "", fmt.Errorf("Invalid byte count %d", n)
+	}
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, result, err := s.readMatch(func(input string) []int {
+		if len(input) >= n {
+			return []int{0, n}
+		}
+		return nil
+	}, 0, 0, timeout)
+	s.observeExpect(start, len(result) >= 2)
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return "", err
+	}
+	s.consume(data, n)
+	return data[:n], err
+}
+
+// ExpectFrame reads a frame of a length-prefixed binary protocol: headerLen bytes of header, followed
+// by the number of payload bytes lengthFn returns for that header. The whole frame (header included)
+// is consumed and returned only once all of it is buffered, so on a timeout, or the end of the
+// stream, in the middle of a frame nothing is consumed and it can be read again once the rest
+// arrives. An error is returned without consuming anything if headerLen or the length lengthFn
+// returns is negative. Options that rewrite the data read, such as filters and line unwrapping,
+// should not be used with binary protocols, and neither should MaxLineLength, since frames without
+// newlines can be mistaken for an overly long line
+func (s *Shell) ExpectFrame(headerLen int, lengthFn func(header []byte) int) ([]byte, error) {
+	if headerLen < 0 {
+		return nil, fmt.Errorf("Invalid frame header length %d", headerLen)
+	}
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	payloadLen := -1
+	data, result, err := s.readMatch(func(input string) []int {
+		if len(input) < headerLen {
+			return nil
+		}
+		if payloadLen < 0 {
+			if payloadLen = lengthFn([]byte(input[:headerLen])); payloadLen < 0 {
+				return []int{0, headerLen}
+			}
+		}
+		if len(input) >= headerLen+payloadLen {
+			return []int{0, headerLen + payloadLen}
+		}
+		return nil
+	}, 0, 0, s.timeout())
+	if payloadLen < 0 && len(result) >= 2 {
+		s.observeExpect(start, false)
+		return nil, fmt.Errorf("Invalid frame payload length %d", payloadLen)
+	}
+	s.observeExpect(start, len(result) >= 2)
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return nil, err
+	}
+	s.consume(data, result[1])
+	return []byte(data[:result[1]]), err
+}
+
+// ReadAvailable consumes and returns whatever data is currently buffered without waiting for a prompt.
+// If nothing is buffered it polls very briefly for new data, returning an empty string if none arrives
+func (s *Shell) ReadAvailable() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failed != nil {
+		return "", s.failed
+	}
+
+	data, _, err := s.read(0)
+	if data == "" && err == nil {
+		data, _, err = s.read(availablePoll)
+		if err == errTimeout {
+			err = nil
+		}
+	}
+	s.resetBuff()
+	s.updateWater()
+	return data, err
+}
+
+// lineMatcher matches everything up to and including the first newline, or all remaining data
+// once EOF has been reached
+func (s *Shell) lineMatcher(input string) []int {
+	if idx := strings.IndexByte(input, '\n'); idx >= 0 {
+		return []int{0, idx + 1}
+	}
+	if s.eof && input != "" {
+		return []int{0, len(input)}
+	}
+	return nil
+}
+
+// readMatch reads data from the buffer until the matcher matches, an error occurs, or the timeout
+// expires. Matching is only attempted once minBytes are buffered or an error occurs and if maxBytes
+// is non-zero, it gives up once more than that is buffered. It returns all the data read along with
+// the match result. It must be called under lock
+func (s *Shell) readMatch(m Matcher, minBytes, maxBytes int, timeout time.Duration) (string, []int, error) {
+	var result []int
+	var timeSpent time.Duration
+	if !s.deadline.IsZero() {
+		if remaining := time.Until(s.deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	// Start by just getting whatever data is in the buffer without waiting - this guarantees a match
+	// on data that is already buffered never waits at all
+	data, dur, err := s.read(0)
+	lastData := time.Now()
+
+	for iterations := 1; ; iterations++ {
+		if s.failed != nil {
+			return data, nil, s.failed
+		}
+		if len(data) >= minBytes || err != nil || s.eof {
+			result = s.match(m, data)
+			if len(result) > 0 && err == errTimeout {
+				err = nil // Shorter than minBytes, so only matched once the wait for more was over
+			}
+		}
+		// If we got an error or matches then we are done...
+		if err != nil || len(result) > 0 {
+			break
+		}
+		// ...and if a prior read already hit EOF, no more data is coming so don't wait for it
+		if s.eof {
+			err = io.EOF
+			break
+		}
+		if maxBytes > 0 && len(data) > maxBytes {
+			err = &TooMuchDataError{Buffered: len(data), Max: maxBytes}
+			break
+		}
+		if err = s.checkLineLength(data); err != nil {
+			break
+		}
+		if max := s.param.MaxRetrieveIterations; max > 0 && iterations >= max {
+			err = ErrTooManyIterations
+			break
+		}
+		timeSpent += dur
+		if timeSpent >= timeout {
+			if len(data) < minBytes {
+				// No more is coming in time, so settle for matching what is buffered
+				result = s.match(m, data)
+			}
+			if len(result) == 0 {
+				err = errTimeout
+			}
+			break
+		}
+		if data != "" && s.param.PollInterval > 0 {
+			timeSpent += s.throttle(timeout - timeSpent)
+		}
+		wait, keepalive := timeout-timeSpent, false
+		if interval := s.param.KeepaliveInterval; interval > 0 {
+			if due := interval - time.Since(lastData); due < wait {
+				wait, keepalive = due, true
+			}
+		}
+		prevLen := len(data)
+		if wait > 0 {
+			data, dur, err = s.read(wait)
+		} else {
+			dur = 0
+		}
+		if len(data) != prevLen {
+			lastData = time.Now()
+		}
+		if keepalive && err == errTimeout {
+			err = nil // Only waited until the keepalive was due
+		}
+		if keepalive && err == nil && time.Since(lastData) >= s.param.KeepaliveInterval {
+			err = s.sendKeepalive()
+			lastData = time.Now()
+		}
+	}
+	return data, result, err
+}
+
+// sendKeepalive sends KeepaliveData for KeepaliveInterval. It is always called under lock, but
+// unlocks while sending
+func (s *Shell) sendKeepalive() error {
+	data := s.param.KeepaliveData
+	if len(data) == 0 {
+		data = []byte("\n")
+	}
+	s.keepalives++
+	s.lock.Unlock()
+	_, err := s.in.Write(data)
+	s.lock.Lock()
+	return err
+}
+
+// skipKeepalivePrompts consumes any bare prompts at the start of the buffer that are expected from
+// keepalives, without waiting. Since the reader won't report it again, any failed read acknowledged
+// while doing so is returned. It is always called under lock
+func (s *Shell) skipKeepalivePrompts() error {
+	for s.keepalives > 0 {
+		data, result, err := s.readPrompt(0, 0)
+		if err != nil && !isReaderErr(err) {
+			err = nil
+		}
+		if len(result) < 6 || strings.TrimSpace(data[result[2]:result[3]]) != "" {
+			return err
+		}
+		s.consume(data, result[1])
+		s.keepalives--
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLineLength returns a LineTooLongError if the last line of data is longer than MaxLineLength
+func (s *Shell) checkLineLength(data string) error {
+	max := s.param.MaxLineLength
+	if max <= 0 || len(data) <= max {
+		return nil
+	}
+	if line := data[strings.LastIndexByte(data, '\n')+1:]; len(line) > max {
+		return &LineTooLongError{Prefix: line[:max], Max: max}
+	}
+	return nil
+}
+
+// throttle waits for PollInterval (or remaining, if less), letting the reader buffer data meanwhile,
+// and returns the time waited. It is always called under lock
+func (s *Shell) throttle(remaining time.Duration) time.Duration {
+	wait := s.param.PollInterval
+	if wait > remaining {
+		wait = remaining
+	}
+	s.lock.Unlock()
+	time.Sleep(wait)
+	s.lock.Lock()
+	return wait
+}
+
+// consume removes all data up to end from the buffer and saves the remainder for the next operation
+func (s *Shell) consume(data string, end int) {
+	// Prepare for the next operation
+	s.resetBuff()
+	// Did we match everything? No, then save that data for next time
+	if end < len(data) {
+		// Write the remaining data back to the buffer
+		io.WriteString(s.buffer, data[end:])
+	}
+	s.updateWater()
+}
+
+// processResults takes the index slice and raw data and converts tem into a slice of matched strings
+func processResults(result []int, data string) []string {
+	subMatchPairs := len(result)
+	matches := make([]string, subMatchPairs/2)
+	for i, j := 0, 0; i < subMatchPairs; i, j = i+2, j+1 {
+		matches[j] = data[result[i]:result[i+1]]
+	}
+	return matches
+}
+
+// Expect takes a matcher and tries to match it against the current data that was received. It returns the
+// entire match, all submatches, and an error, if any occurred.
+func (s *Shell) Expect(m Matcher) (string, []string, error) {
+	match, err := s.expect(m, 0, s.timeout())
+	return match.Full, match.Groups, err
+}
+
+// ExpectEach expects a match of m on each of the next n responses, such as to validate the output of
+// several commands sent back to back. It returns the Match of each. On the first response that fails,
+// it returns the matches before it and an EachError with the index of that response
+func (s *Shell) ExpectEach(n int, m Matcher) ([]Match, error) {
+	matches := make([]Match, 0, n)
+	for i := 0; i < n; i++ {
+		match, err := s.expect(m, 0, s.timeout())
+		if match.Groups == nil {
+			return matches, &EachError{Index: i, Err: err}
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
+// ExpectMax works like Expect, but fails with a TooMuchDataError if more than maxBytes are buffered
+// before the prompt is matched. Nothing is consumed in that case
+func (s *Shell) ExpectMax(m Matcher, maxBytes int) (string, []string, error) {
+	match, err := s.expect(m, maxBytes, s.timeout())
+	return match.Full, match.Groups, err
+}
+
+// ExpectIndices works like Expect, but returns the retrieved body along with the raw result of the
+// matcher against it, so each pair of indices can be used to slice the body directly. The prompt is
+// not included in either
+func (s *Shell) ExpectIndices(m Matcher) (body string, indices []int, err error) {
+	start := time.Now()
+	_, groups, err := s.retrieve(0, s.timeout())
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return "", nil, err
+	}
+	body = groups[0]
+	if indices = m(body); len(indices) < 2 {
+		s.observeExpect(start, false)
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return body, nil, err
+	}
+	s.observeExpect(start, true)
+	return body, indices, err
+}
+
+// ExpectAfter retrieves the next body and finds the first match of the header regex in it, returning
+// the rest of the body following the header (up to the prompt) along with the Match of the header.
+// It is handy for skipping boilerplate before the data of interest
+func (s *Shell) ExpectAfter(header string) (after string, match Match, err error) {
+	m := RegexMatcher(header)
+
+	start := time.Now()
+	full, groups, err := s.retrieve(0, s.timeout())
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return "", Match{}, err
+	}
+	result := m(groups[0])
+	s.observeExpect(start, len(result) >= 2)
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return "", Match{}, err
+	}
+	results := append(processResults(result, groups[0]), groups[1:]...)
+	match = Match{Full: full, Groups: results, Body: groups[0], Prompt: groups[1]}
+	return groups[0][result[1]:], match, err
+}
+
+// ExpectWithin works like Expect, but only matches m against the last n bytes of the body, such as
+// for a status that must appear just before the prompt (see TailMatcher)
+func (s *Shell) ExpectWithin(m Matcher, n int) (string, []string, error) {
+	return s.Expect(TailMatcher(n, m))
+}
+
+// ExpectBodyAtPrompt reads until the buffered data reaches a prompt and bodyMatcher matches all the
+// data before that prompt, as one atomic condition. Unlike Expect, a prompt-like line reached before
+// the body is complete doesn't end the match - the next prompt is tried as well, with everything
+// before it as the body. Everything through the prompt is consumed. The Match groups are the results
+// of bodyMatcher followed by the prompt
+func (s *Shell) ExpectBodyAtPrompt(bodyMatcher Matcher) (Match, error) {
+	start := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prompt := s.promptMatcher()
+	var bodyResult []int
+	m := func(input string) []int {
+		for offset := 0; offset < len(input); {
+			result := prompt(input[offset:])
+			if len(result) < 6 || result[1] == 0 {
+				return nil
+			}
+			bodyEnd := offset + result[3]
+			if bodyResult = bodyMatcher(input[:bodyEnd]); len(bodyResult) >= 2 {
+				return []int{0, offset + result[1], 0, bodyEnd, offset + result[4], offset + result[5]}
+			}
+			offset += result[1]
+		}
+		return nil
+	}
+
+	data, result, err := s.readMatch(m, s.param.MinBytesBeforeMatch, 0, s.timeout())
+	s.observeExpect(start, len(result) >= 6)
+	if len(result) < 6 {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		s.record(Operation{Time: start, Err: err})
+		return Match{}, err
+	}
+	body, prompted := data[:result[3]], data[result[4]:result[5]]
+	s.prompted = true
+	s.lastPrompt = prompted
+	s.record(Operation{Time: start, Body: body, Prompt: prompted, Err: err})
+	s.consume(data, result[1])
+	groups := append(processResults(bodyResult, body), prompted)
+	return Match{Full: data[:result[1]], Groups: groups, Body: body, Prompt: prompted}, err
+}
+
+// ExpectLines works like Expect waiting up to timeout, but returns the lines of the matched body
+// without their line endings (either "\n" or "\r\n"). A line ending at the very start of the body
+// (the rest of the previous prompt's line) or at the very end doesn't produce an empty line, so an
+// empty body returns no lines, but blank lines in between are kept
+func (s *Shell) ExpectLines(m Matcher, timeout time.Duration) ([]string, error) {
+	match, err := s.expect(m, 0, timeout)
+	if match.Groups == nil {
+		return nil, err
+	}
+	return splitLines(match.Body), err
+}
+
+// splitLines splits body into lines as described by ExpectLines
+func splitLines(body string) []string {
+	body = strings.TrimPrefix(strings.TrimPrefix(body, "\r"), "\n")
+	body = strings.TrimSuffix(strings.TrimSuffix(body, "\n"), "\r")
+	if body == "" {
+		return []string{}
+	}
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// expect is the implementation of Expect returning a Match waiting up to timeout. If maxBytes is
+// non-zero, a TooMuchDataError is returned once more than maxBytes are buffered
+func (s *Shell) expect(m Matcher, maxBytes int, timeout time.Duration) (Match, error) {
+	start := time.Now()
+	full, groups, err := s.retrieve(maxBytes, timeout)
+	match, err := matchRetrieved(m, full, groups, err)
+	s.observeExpect(start, match.Groups != nil)
+	return match, err
+}
+
+// matchRetrieved matches the results of a retrieve with the matcher returning a Match
+func matchRetrieved(m Matcher, full string, groups []string, err error) (Match, error) {
+	if len(groups) < 2 {
+		return Match{}, err
+	}
+	full, results, err := matchBody(m, full, groups, err)
+	if results == nil {
+		return Match{}, err
+	}
+	return Match{Full: full, Groups: results, Body: groups[0], Prompt: groups[1]}, err
+}
+
+// RegisterErrorPatterns adds matchers that ExpectOrError checks every body against, in addition to
+// the built-in ErrorPatterns
+func (s *Shell) RegisterErrorPatterns(patterns ...Matcher) {
+	s.lock.Lock()
+	// Never append into a backing array possibly shared with a cloned config
+	s.param.errorPatterns = append(s.param.errorPatterns[:len(s.param.errorPatterns):len(s.param.errorPatterns)],
+		patterns...)
+	s.lock.Unlock()
+}
+
+// ExpectOrError works like Expect, but first checks the retrieved body against ErrorPatterns and any
+// patterns added by RegisterErrorPatterns. If any of them match, a CommandError is returned instead
+func (s *Shell) ExpectOrError(m Matcher) (Match, error) {
+	start := time.Now()
+	full, groups, err := s.retrieve(0, s.timeout())
+	if len(groups) >= 2 {
+		s.lock.Lock()
+		patterns := append(errorMatchers[:len(errorMatchers):len(errorMatchers)], s.param.errorPatterns...)
+		s.lock.Unlock()
+
+		for _, pattern := range patterns {
+			if result := pattern(groups[0]); len(result) >= 2 {
+				s.observeExpect(start, false)
+				return Match{}, &CommandError{Text: groups[0][result[0]:result[1]], Body: groups[0], Prompt: groups[1]}
+			}
+		}
+	}
+	match, err := matchRetrieved(m, full, groups, err)
+	s.observeExpect(start, match.Groups != nil)
+	return match, err
+}
+
+// ExpectRetry sends the line send and then expects a match on the response. If that fails for any
+// reason, it waits for backoff (doubling each attempt), discards any stale buffered data, and then
+// tries again, up to attempts times. It returns the first successful match or the last error
+func (s *Shell) ExpectRetry(send string, m Matcher, attempts int, backoff time.Duration) (Match, error) {
+	var match Match
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if err = s.discard(); err != nil {
+				return Match{}, err
+			}
+		}
+		if err = s.SendLine(send); err != nil {
+			continue
+		}
+		s.delayAfterSend()
+		if match, err = s.expect(m, 0, s.timeout()); match.Groups != nil {
+			return match, err
+		}
+	}
+	return match, err
+}
+
+// SyncPrompt nudges the device to show its prompt, such as when attaching to a console mid-session
+// where nothing is output until Enter is pressed. It discards any stale buffered data, sends a
+// newline, and waits up to timeout for a prompt. Any additional bare prompts already buffered after
+// it (ex: one per newline the device saw) are consumed too, and the last prompt is returned
+func (s *Shell) SyncPrompt(timeout time.Duration) (string, error) {
+	if err := s.discard(); err != nil {
+		return "", err
+	}
+	if err := s.SendLine(""); err != nil {
+		return "", err
+	}
+	s.delayAfterSend()
+	start := time.Now()
+	_, groups, err := s.retrieve(0, timeout)
+	s.observeExpect(start, groups != nil)
+	if len(groups) < 2 {
+		return "", err
+	}
+	prompt := groups[1]
+	for {
+		// Never wait - only consume the extra prompts that have already arrived
+		s.lock.Lock()
+		data, result, readErr := s.readPrompt(0, 0)
+		if readErr != nil && readErr != errTimeout && readErr != io.EOF && (err == nil || err == io.EOF) {
+			err = s.disconnected(data, readErr)
+		}
+		if len(result) < 6 || strings.TrimSpace(data[result[2]:result[3]]) != "" {
+			s.lock.Unlock()
+			break
+		}
+		prompt = data[result[4]:result[5]]
+		s.lastPrompt = prompt
+		s.consume(data, result[1])
+		s.lock.Unlock()
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return prompt, err
+}
+
+// Ping checks that the session is still responsive by sending a newline and waiting up to timeout
+// for the prompt to come back. Like SyncPrompt, which it is built on, any stale buffered data is
+// discarded first so an old prompt can't answer for the shell, and any extra bare prompts are consumed
+func (s *Shell) Ping(timeout time.Duration) error {
+	_, err := s.SyncPrompt(timeout)
+	return err
+}
+
+// SkipToPrompt retrieves the next prompt waiting up to timeout and discards the body before it (ex:
+// the output of a throwaway navigation command), returning only whether the prompt was reached
+func (s *Shell) SkipToPrompt(timeout time.Duration) error {
+	start := time.Now()
+	_, groups, err := s.retrieve(0, timeout)
+	s.observeExpect(start, len(groups) >= 2)
+	if len(groups) >= 2 && err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// AutoDetectPrompt sends a newline and waits up to timeout for the output to end in a line of one or
+// more non-whitespace characters, which it takes to be the prompt and passes to SetPrompt so future
+// operations match it exactly. All data through the prompt is consumed. This heuristic fails for
+// prompts containing whitespace ("user@host:~ $"), and can mistake a partial line of output still
+// arriving for the prompt, so it is best used on an otherwise idle session
+func (s *Shell) AutoDetectPrompt(timeout time.Duration) error {
+	if err := s.SendLine(""); err != nil {
+		return err
+	}
+	s.delayAfterSend()
+	m := RegexMatcher(fmt.Sprintf(retrieveEndRegex, defaultAnchorStart, defaultPromptRegex, defaultAnchorEnd))
+
+	start := time.Now()
+	s.lock.Lock()
+	data, result, err := s.readMatch(m, 0, 0, timeout)
+	s.observeExpect(start, len(result) >= 6)
+	if len(result) < 6 {
+		s.lock.Unlock()
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return err
+	}
+	prompt := data[result[4]:result[5]]
+	s.prompted = true
+	s.lastPrompt = prompt
+	s.consume(data, result[1])
+	s.lock.Unlock()
+
+	s.SetPrompt(prompt)
+	return nil
+}
+
+// ExpectStable repeatedly sends the line send and retrieves the response, waiting interval between
+// polls, until the same body is returned polls times in a row (ex: until a routing table stops
+// changing). It returns that body, or the first send or retrieve error. NOTE: Output that never
+// stabilizes polls forever, so bound it with WithBudget
+func (s *Shell) ExpectStable(send string, polls int, interval time.Duration) (string, error) {
+	var last string
+	for same := 0; ; {
+		if err := s.SendLine(send); err != nil {
+			return "", err
+		}
+		s.delayAfterSend()
+		start := time.Now()
+		_, groups, err := s.retrieve(0, s.timeout())
+		s.observeExpect(start, groups != nil)
+		if len(groups) < 2 {
+			return "", err
+		}
+		if same > 0 && groups[0] == last {
+			same++
+		} else {
+			last, same = groups[0], 1
+		}
+		if same >= polls {
+			if err == io.EOF {
+				err = nil
+			}
+			return last, err
+		}
+		time.Sleep(interval)
+	}
+}
+
+// discard throws away all data currently buffered. A failed read acknowledged while doing so is
+// returned as a DisconnectedError, since the reader won't report it again
+func (s *Shell) discard() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, _, err := s.read(0)
+	s.resetBuff()
+	s.updateWater()
+	if s.failed != nil {
+		return s.failed
+	}
+	if err == io.EOF {
+		err = nil // Already recorded as EOF, so the next read fails fast anyway
+	}
+	return s.disconnected(data, err)
+}
+
+// matchBody matches the body of retrieved results with the matcher. It returns the Expect results
+func matchBody(m Matcher, full string, groups []string, err error) (string, []string, error) {
+	// We base the 2nd match purely on the body we retrieved
+	result := m(groups[0])
+	if len(result) < 2 {
+		if err == nil || err == io.EOF {
+			// Diagnose a pattern written expecting to match the prompt too
+			into := m(groups[0] + groups[1])
+			err = &BodyMismatchError{Body: groups[0], Prompt: groups[1],
+				IntoPrompt: len(into) >= 2 && into[1] > len(groups[0])}
+		}
+		return "", nil, err
+	}
+	results := processResults(result, groups[0])
+	// Add the original prompt matches back onto the results
+	results = append(results, groups[1:]...)
+	return full, results, err
+}
+
+// BufferedLen returns the number of bytes currently buffered (ex: carried over after the prompt of the
+// last operation) without consuming anything. Unlike PendingPrompts, it doesn't match anything
+func (s *Shell) BufferedLen() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buffer.Len()
+}
+
+// PendingPrompts returns the number of complete prompt delimited chunks currently buffered that can
+// be retrieved without waiting. Nothing is consumed
+func (s *Shell) PendingPrompts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data := s.bufferString()
+	count := 0
+	for offset := 0; offset < len(data); {
+		result := s.promptMatcher()(data[offset:])
+		if len(result) < 2 || result[1] == 0 {
+			break
+		}
+		count++
+		offset += result[1]
+	}
+	return count
+}
+
+// promptMatcher returns the matcher used to retrieve the text before the prompt
+func (s *Shell) promptMatcher() Matcher {
+	strict := s.param.StrictPrompt || s.param.PromptConfirmWindow > 0
+	if split := s.param.split; split != nil {
+		if !strict {
+			return split
+		}
+		return func(input string) []int {
+			if result := split(input); len(result) >= 2 && result[1] == len(input) {
+				return result
+			}
+			return nil
+		}
+	}
+	if strict {
+		return s.param.retrieveEnd
+	}
+	return s.param.retrieve
+}
+
+// readPrompt reads data from the buffer until the prompt is matched. It must be called under lock
+func (s *Shell) readPrompt(maxBytes int, timeout time.Duration) (string, []int, error) {
+	m, window := s.promptMatcher(), s.param.PromptConfirmWindow
+	if window <= 0 {
+		return s.readMatch(m, s.param.MinBytesBeforeMatch, maxBytes, timeout)
+	}
+
+	start := time.Now()
+	data, result, err := s.readMatch(m, s.param.MinBytesBeforeMatch, maxBytes, timeout)
+	for len(result) > 0 && err == nil && !s.eof {
+		// Only accept the match once the window passes without any new data
+		_, _, waitErr := s.read(window)
+		if waitErr == errTimeout {
+			break
+		}
+		data, result, err = s.readMatch(m, s.param.MinBytesBeforeMatch, maxBytes, timeout-time.Since(start))
+		if err == nil {
+			err = waitErr
+		}
+	}
+	return data, result, err
+}
+
+// ExpectScanf retrieves the next body and scans it with fmt.Sscanf using format, storing the values
+// in args. Since Sscanf requires newlines to match exactly, leading and trailing whitespace (such as
+// the newline after the previous prompt) is trimmed from the body first
+func (s *Shell) ExpectScanf(format string, args ...interface{}) error {
+	start := time.Now()
+	_, groups, err := s.retrieve(0, s.timeout())
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return err
+	}
+	_, scanErr := fmt.Sscanf(strings.TrimSpace(groups[0]), format, args...)
+	s.observeExpect(start, scanErr == nil)
+	return scanErr
+}
+
+// ExpectAbsent retrieves the next prompt waiting up to timeout and succeeds only if the forbidden
+// regex does not match anywhere in the body (ex: the output must not contain "ERROR"). Otherwise, a
+// ForbiddenMatchError with the offending text is returned. Like RegexMatcher, it panics if forbidden
+// is invalid
+func (s *Shell) ExpectAbsent(forbidden string, timeout time.Duration) (Match, error) {
+	m := RegexMatcher(forbidden)
+
+	start := time.Now()
+	full, groups, err := s.retrieve(0, timeout)
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return Match{}, err
+	}
+	if result := m(groups[0]); len(result) >= 2 {
+		s.observeExpect(start, false)
+		return Match{}, &ForbiddenMatchError{Text: groups[0][result[0]:result[1]], Body: groups[0], Prompt: groups[1]}
+	}
+	s.observeExpect(start, true)
+	return Match{Full: full, Groups: groups, Body: groups[0], Prompt: groups[1]}, err
+}
+
+// ExpectEmptyBody retrieves the next prompt waiting up to timeout and returns nil only if the body
+// before it is empty or only whitespace (see StrictEmptyBody). Otherwise, an UnexpectedBodyError
+// containing the body is returned. This asserts a command produced no output
+func (s *Shell) ExpectEmptyBody(timeout time.Duration) error {
+	start := time.Now()
+	_, groups, err := s.retrieve(0, timeout)
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return err
+	}
+	body := groups[0]
+	if !s.param.StrictEmptyBody {
+		body = strings.TrimSpace(body)
+	}
+	s.observeExpect(start, body == "")
+	if body != "" {
+		return &UnexpectedBodyError{Body: groups[0], Prompt: groups[1]}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// ExpectMapRegex retrieves the next body and finds every match of re in it, returning a map from
+// the keyGroup submatch of each to its valGroup submatch. If a key matches more than once, the last
+// match wins. ErrNoMatches is returned if re doesn't match at all. Like RegexMatcher, it panics if
+// re is invalid
+func (s *Shell) ExpectMapRegex(re string, keyGroup, valGroup int) (map[string]string, error) {
+	r := regexp.MustCompile(matchFmt + re)
+	if groups := r.NumSubexp(); keyGroup < 1 || keyGroup > groups || valGroup < 1 || valGroup > groups {
+		return nil, fmt.Errorf("Group out of range: regex has %d groups", groups)
+	}
+
+	start := time.Now()
+	_, groups, err := s.retrieve(0, s.timeout())
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return nil, err
+	}
+	matches := r.FindAllStringSubmatch(groups[0], -1)
+	s.observeExpect(start, matches != nil)
+	if matches == nil {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return nil, err
+	}
+	results := make(map[string]string, len(matches))
+	for _, match := range matches {
+		results[match[keyGroup]] = match[valGroup]
+	}
+	return results, err
+}
+
+// ExpectIgnoring works like Expect, but any retrieved body that doesn't match target and does match
+// one of the ignore matchers (a banner, a keepalive, etc.) is discarded and the next one retrieved.
+// The timeout applies to the operation as a whole. It returns a BodyMismatchError on the first body
+// that matches neither target nor any of the ignore matchers
+func (s *Shell) ExpectIgnoring(target Matcher, ignore ...Matcher) (string, []string, error) {
+	start := time.Now()
+	for {
+		full, groups, err := s.retrieve(0, s.timeout()-time.Since(start))
+		if len(groups) < 2 {
+			s.observeExpect(start, false)
+			return "", nil, err
+		}
+		if len(target(groups[0])) < 2 && matchesAny(ignore, groups[0]) {
+			continue
+		}
+		full, results, err := matchBody(target, full, groups, err)
+		s.observeExpect(start, results != nil)
+		return full, results, err
+	}
+}
+
+// ExpectFunc keeps retrieving, appending each body to those before it, until pred returns true for
+// the accumulated bodies, which are then returned. The timeout applies to the operation as a whole.
+// Any bodies already retrieved are consumed even if it fails
+func (s *Shell) ExpectFunc(pred func(body string) bool, timeout time.Duration) (string, error) {
+	start := time.Now()
+	var body strings.Builder
+	for {
+		_, groups, err := s.retrieve(0, timeout-time.Since(start))
+		if len(groups) < 2 {
+			s.observeExpect(start, false)
+			return "", err
+		}
+		body.WriteString(groups[0])
+		if pred(body.String()) {
+			s.observeExpect(start, true)
+			return body.String(), err
+		}
+	}
+}
+
+// ExpectJoined works like Expect, but for a response that spans multiple prompts (ex: output that
+// re-prints the prompt part way through). It retrieves up to maxChunks bodies, joining them together
+// and matching against the joined text after each retrieve. The returned Match uses the joined body
+// and the last prompt. The timeout applies to the operation as a whole. If the joined text still
+// doesn't match after maxChunks bodies, a BodyMismatchError with the joined body is returned
+func (s *Shell) ExpectJoined(m Matcher, maxChunks int) (Match, error) {
+	start := time.Now()
+	var body strings.Builder
+	var err error
+	for i := 0; i < maxChunks; i++ {
+		var full string
+		var groups []string
+		full, groups, err = s.retrieve(0, s.timeout()-time.Since(start))
+		if len(groups) < 2 {
+			break
+		}
+		body.WriteString(groups[0])
+		// Replace the body with the joined bodies, leaving the prompt (if any) at the end of the full match
+		full = body.String() + full[len(groups[0]):]
+		groups[0] = body.String()
+
+		var match Match
+		if match, err = matchRetrieved(m, full, groups, err); match.Groups != nil {
+			s.observeExpect(start, true)
+			return match, err
+		}
+	}
+	s.observeExpect(start, false)
+	if err == nil || err == io.EOF {
+		err = ErrNoMatches
+	}
+	return Match{}, err
+}
+
+// matchesAny returns true if any of the matchers match the input
+func matchesAny(matchers []Matcher, input string) bool {
+	for _, m := range matchers {
+		if len(m(input)) >= 2 {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpectRegex takes a regex as a string, compiles it, and calls Expect looking for matches. The
+// return values are identical to Expect.
+func (s *Shell) ExpectRegex(re string) (string, []string, error) {
+	return s.Expect(RegexMatcher(re))
+}
+
+// ExpectCapture works like ExpectRegex waiting up to timeout, but returns only the given submatch of
+// the regex (0 is the whole match). An error is returned without retrieving anything if the regex
+// has no such group. Like RegexMatcher, it panics if re is invalid
+func (s *Shell) ExpectCapture(re string, group int, timeout time.Duration) (string, error) {
+	if groups := regexp.MustCompile(matchFmt + re).NumSubexp(); group < 0 || group > groups {
+		return "", fmt.Errorf("Group out of range: regex has %d groups", groups)
+	}
+
+	match, err := s.expect(RegexMatcher(re), 0, timeout)
+	if match.Groups == nil {
+		return "", err
+	}
+	return match.Groups[group], err
+}
+
+// ExpectRegexOr works like ExpectRegex, but returns only the first match group of the regex (or the
+// whole match if it has no groups). If no prompt arrives within the timeout or the body doesn't
+// match, fallback is returned without an error. Like Expect, a body is consumed once its prompt is
+// found whether or not it matched, however, nothing is consumed when the timeout expires
+func (s *Shell) ExpectRegexOr(re, fallback string) (string, error) {
+	compiled := regexp.MustCompile(matchFmt + re)
+	_, groups, err := s.Expect(func(input string) []int {
+		return compiled.FindStringSubmatchIndex(input)
+	})
+	if groups == nil {
+		if _, ok := err.(*BodyMismatchError); ok || err == ErrNoMatches || isTimeout(err) {
+			err = nil
+		}
+		return fallback, err
+	}
+	if compiled.NumSubexp() > 0 {
+		return groups[1], err
+	}
+	return groups[0], err
+}
+
+// ExpectStr takes a string, converts it to a matcher, and calls Expect looking for matches. The
+// return values are identical to Expect.
+func (s *Shell) ExpectStr(str string) (string, []string, error) {
+	return s.Expect(StrMatcher(str))
+}
+
+// read data from the buffer and return it, waiting up to timeout if no data present. In addition
+// to a string of the actual data, the actual duration of time waited is returned
+func (s *Shell) read(timeout time.Duration) (data string, d time.Duration, err error) {
+	var reads int
+	reads, err = ackReads(s.ch)
+	data = s.bufferString()
+
+	// Only wait if we have a timeout, no error so far, and then only if we have no data OR we did zero reads
+	if timeout > 0 && err == nil && (data == "" || reads == 0) {
+		d, err = s.waitForData(timeout)
+		data = s.bufferString()
+	}
+	return
+}
+
+// bufferString returns the buffer contents, normalizing it if requested
+func (s *Shell) bufferString() string {
+	if s.param.NormalizeUnicode {
+		return norm.NFC.String(s.buffer.String())
+	}
+	return s.buffer.String()
+}
+
+// ackReads acknowledges all outstanding read operations done by reader and returns number of
+// channel reads and the first error if there is one. Later ones are dropped, as are the nil wakeups
+// from FeedForTest and Fail, so a reader error queued before them is never lost
+func ackReads(ch chan error) (int, error) {
+	var err error
+	reads := 0
 	for {
 		select {
-		case err = <-ch:
+		case readErr := <-ch:
+			if err == nil {
+				err = readErr
+			}
 			reads++
 		default:
 			return reads, err
@@ -253,10 +2843,14 @@ func (s *Shell) waitForData(timeout time.Duration) (time.Duration, error) {
 	s.lock.Unlock()
 	defer s.lock.Lock()
 
+	if s.param.SynchronousRead {
+		return s.readSync(timeout)
+	}
+
 	select {
 	case err := <-s.ch:
 		return time.Since(t), err
 	case <-time.After(timeout):
-		return timeout, errors.New("Read timed out")
+		return timeout, errTimeout
 	}
 }
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/iotest"
 	"time"
@@ -53,11 +55,11 @@ func TestMatch(t *testing.T) {
 			func(s string) io.Reader { return &blockingReader{data: s} }},
 		{"Strings", "test.+", data, []string{"test\n", "router#"}, nil,
 			func(s string) io.Reader { return strings.NewReader(s) }},
-		{"StringsNoMatch", "testing.+", "", nil, cliexpect.ErrNoMatches,
+		{"StringsNoMatch", "testing.+", "", nil, &cliexpect.BodyMismatchError{Body: "test\n", Prompt: "router#"},
 			func(s string) io.Reader { return strings.NewReader(s) }},
 		{"DataErrReader", "test.+", data, []string{"test\n", "router#"}, io.EOF,
 			func(s string) io.Reader { return iotest.DataErrReader(strings.NewReader(s)) }},
-		{"DataErrReaderNoMatch", "testing.+", "", nil, cliexpect.ErrNoMatches,
+		{"DataErrReaderNoMatch", "testing.+", "", nil, &cliexpect.BodyMismatchError{Body: "test\n", Prompt: "router#"},
 			func(s string) io.Reader { return iotest.DataErrReader(strings.NewReader(s)) }},
 		{"OneByteReader", "test.+", data, []string{"test\n", "router#"}, nil,
 			func(s string) io.Reader { return iotest.OneByteReader(strings.NewReader(s)) }},
@@ -160,6 +162,20 @@ func TestSendBytes(t *testing.T) {
 	assert.Equal(t, data, w.data)
 }
 
+func TestSendRaw(t *testing.T) {
+	w := new(writer)
+	sh := cliexpect.NewWithParam(w, new(blockingReader), cliexpect.ShellParam{HistorySize: 5})
+	data := []byte{0x1b, '[', 'A', 0x00}
+
+	err := sh.WithBudget(0, func(sh *cliexpect.Shell) error {
+		assert.Equal(t, cliexpect.ErrBudgetExpired, sh.SendBytes([]byte("x")))
+		return sh.SendRaw(data)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, data, w.data)
+	assert.Empty(t, sh.History())
+}
+
 func TestSend(t *testing.T) {
 	w := new(writer)
 	sh := cliexpect.New(w, new(blockingReader))
@@ -177,3 +193,1961 @@ func TestSendLine(t *testing.T) {
 	assert.NoError(t, sh.SendLine(data))
 	assert.Equal(t, []byte(data+"\n"), w.data)
 }
+
+func TestFullExcludesPrompt(t *testing.T) {
+	data := "test\nrouter#"
+	sh := cliexpect.New(new(writer), &blockingReader{data: data})
+	sh.SetPromptRegex(`\S+#`)
+	sh.SetFullIncludesPrompt(false)
+
+	full, groups, err := sh.ExpectRegex("test.+")
+	assert.NoError(t, err)
+	assert.Equal(t, "test\n", full)
+	assert.Equal(t, []string{"test\n", "router#"}, groups)
+}
+
+func TestFeedForTest(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("test\n")
+	sh.FeedForTest("router#")
+
+	full, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "test\nrouter#", full)
+	assert.Equal(t, []string{"test\n", "router#"}, groups)
+}
+
+func TestExpectLine(t *testing.T) {
+	sh := cliexpect.New(new(writer), iotest.DataErrReader(strings.NewReader("line 1\r\nline 2\nline 3")))
+
+	for _, line := range []string{"line 1", "line 2", "line 3"} {
+		t.Run(line, func(t *testing.T) {
+			actual, err := sh.ExpectLine()
+			// Whichever operation acknowledges the read sees the EOF - both outcomes are fine
+			if err != io.EOF && err != nil {
+				t.Fail()
+			}
+			assert.Equal(t, line, actual)
+		})
+	}
+}
+
+func TestMinBytesBeforeMatch(t *testing.T) {
+	r, w := io.Pipe()
+	// Reading synchronously, each write only returns once Retrieve has read it
+	param := cliexpect.ShellParam{MinBytesBeforeMatch: 15, SynchronousRead: true}
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	sh.SetPromptRegex(`\S+#`)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		full, groups, err := sh.Retrieve()
+		assert.NoError(t, err)
+		assert.Equal(t, "router# is up\nrouter#", full)
+		assert.Equal(t, []string{"router# is up\n", "router#"}, groups)
+	}()
+
+	// Partial line that looks like a prompt until the rest of the line arrives
+	w.Write([]byte("router#"))
+	w.Write([]byte(" is up\nrouter#"))
+	<-done
+}
+
+func TestMinBytesBeforeMatchShort(t *testing.T) {
+	param := cliexpect.ShellParam{MinBytesBeforeMatch: 100, Timeout: 20 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+
+	// The whole response is shorter, so it matches once the timeout expires, without an error
+	sh.FeedForTest("ok\nrouter#")
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ok\n", "router#"}, groups)
+}
+
+func TestPauseResume(t *testing.T) {
+	r, w := io.Pipe()
+	param := cliexpect.ShellParam{Timeout: 50 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	sh.SetPromptRegex(`\S+#`)
+
+	_, err := w.Write([]byte("a\nrouter#"))
+	assert.NoError(t, err)
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a\n", "router#"}, groups)
+
+	sh.Pause()
+	// The reader is already blocked in a read, so this data is still buffered
+	_, err = w.Write([]byte("b\nrouter#"))
+	assert.NoError(t, err)
+	go w.Write([]byte("c\nrouter#"))
+
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b\n", "router#"}, groups)
+	_, _, err = sh.Retrieve()
+	assert.Error(t, err)
+
+	sh.Resume()
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c\n", "router#"}, groups)
+}
+
+func TestSkipLeadingPrompt(t *testing.T) {
+	// Same layout as ExampleShell
+	input := `user@host:~$ 
+test.py: ASCII text
+user@host:~$ `
+
+	param := cliexpect.ShellParam{SkipLeadingPrompt: true}
+	sh := cliexpect.NewWithParam(new(writer), strings.NewReader(input), param)
+	sh.SetPromptRegex(`\w+@\w+:\S+\$ `)
+
+	_, groups, err := sh.Retrieve()
+	if err != io.EOF && err != nil {
+		t.Fail()
+	}
+	assert.Equal(t, []string{"\ntest.py: ASCII text\n", "user@host:~$ "}, groups)
+}
+
+func TestExpectRegexOr(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: "Serial: ABC123\nrouter#\nno serial\nrouter#"})
+	sh.SetPromptRegex(`\S+#`)
+
+	serial, err := sh.ExpectRegexOr(`Serial: (\w+)`, "unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, "ABC123", serial)
+
+	serial, err = sh.ExpectRegexOr(`Serial: (\w+)`, "unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, "unknown", serial)
+}
+
+func TestExpectRegexOrTimeout(t *testing.T) {
+	param := cliexpect.ShellParam{Timeout: 1 * time.Nanosecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+
+	value, err := sh.ExpectRegexOr("testing", "fallback")
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback", value)
+}
+
+func TestExpectRegexOrPartialTimeout(t *testing.T) {
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond, EnablePartialMatchDiagnostics: true}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`router#`)
+	sh.FeedForTest("\n\nrout")
+
+	// The timeout is still a timeout when diagnostics report the partial prompt
+	value, err := sh.ExpectRegexOr("testing", "fallback")
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback", value)
+}
+
+func TestReadUntil(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: "rec1\x00rec2\x00partial"})
+
+	for _, rec := range []string{"rec1", "rec2"} {
+		data, err := sh.ReadUntil("\x00", time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, rec, data)
+	}
+
+	data, err := sh.ReadUntil("\x00", 10*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, "", data)
+}
+
+func TestBodyMismatchIntoPrompt(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+
+	sh.FeedForTest("Version 1.2\nrouter#")
+	_, _, err := sh.ExpectRegex(`1\.2\nrouter#`)
+	assert.Equal(t, &cliexpect.BodyMismatchError{Body: "Version 1.2\n", Prompt: "router#", IntoPrompt: true}, err)
+	assert.Contains(t, err.Error(), "only matches into the prompt")
+
+	sh.FeedForTest("Version 1.2\nrouter#")
+	_, _, err = sh.ExpectRegex(`1\.3`)
+	assert.Equal(t, &cliexpect.BodyMismatchError{Body: "Version 1.2\n", Prompt: "router#"}, err)
+}
+
+func TestExpectIgnoring(t *testing.T) {
+	data := "%BANNER: maintenance\nrouter#\nkeepalive\nrouter#\nVersion 1.2\nrouter#\nunexpected\nrouter#"
+	sh := cliexpect.New(new(writer), &blockingReader{data: data})
+	sh.SetPromptRegex(`\S+#`)
+	ignore := []cliexpect.Matcher{cliexpect.RegexMatcher("^%BANNER"), cliexpect.StrMatcher("keepalive")}
+
+	_, groups, err := sh.ExpectIgnoring(cliexpect.RegexMatcher(`Version (\S+)`), ignore...)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Version 1.2", "1.2", "router#"}, groups)
+
+	_, groups, err = sh.ExpectIgnoring(cliexpect.RegexMatcher(`Version (\S+)`), ignore...)
+	assert.Equal(t, &cliexpect.BodyMismatchError{Body: "\nunexpected\n", Prompt: "router#"}, err)
+	assert.Nil(t, groups)
+}
+
+func TestCloneConfig(t *testing.T) {
+	orig := cliexpect.New(new(writer), new(blockingReader))
+	orig.SetPromptRegex(`(\w+)#`)
+	orig.SetFullIncludesPrompt(false)
+
+	sh := orig.CloneConfig(new(writer), &blockingReader{data: "test\nswitch#"})
+	full, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "test\n", full)
+	assert.Equal(t, []string{"test\n", "switch#", "switch"}, groups)
+}
+
+func TestReadAvailable(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.FeedForTest("partial out")
+
+	data, err := sh.ReadAvailable()
+	assert.NoError(t, err)
+	assert.Equal(t, "partial out", data)
+
+	data, err = sh.ReadAvailable()
+	assert.NoError(t, err)
+	assert.Equal(t, "", data)
+}
+
+func TestExpectMax(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("test\nrouter#")
+
+	_, groups, err := sh.ExpectMax(cliexpect.StrMatcher("test"), 12)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test", "router#"}, groups)
+
+	sh.FeedForTest("this is far too much data")
+	_, groups, err = sh.ExpectMax(cliexpect.StrMatcher("test"), 12)
+	assert.Equal(t, &cliexpect.TooMuchDataError{Buffered: 25, Max: 12}, err)
+	assert.Nil(t, groups)
+}
+
+func TestMaxLineLength(t *testing.T) {
+	param := cliexpect.ShellParam{MaxLineLength: 8, Timeout: time.Second}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+
+	// Long lines are fine as long as they end
+	sh.FeedForTest("a long line of output\nrouter#")
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a long line of output\n", "router#"}, groups)
+
+	sh.FeedForTest("\nok\n\x00\x01\x02\x03\x04\x05\x06\x07\x08")
+	start := time.Now()
+	_, _, err = sh.Retrieve()
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, &cliexpect.LineTooLongError{Prefix: "\x00\x01\x02\x03\x04\x05\x06\x07", Max: 8}, err)
+}
+
+func TestPartialMatchDiagnostics(t *testing.T) {
+	param := cliexpect.ShellParam{EnablePartialMatchDiagnostics: true, Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("out\nrouter")
+
+	_, _, err := sh.Retrieve()
+	if assert.IsType(t, &cliexpect.PartialMatchError{}, err) {
+		pm := err.(*cliexpect.PartialMatchError)
+		assert.Equal(t, 4, pm.Offset)
+		assert.Equal(t, "router", pm.Matched)
+		assert.Equal(t, "#", pm.Missing)
+		assert.Equal(t, `Read timed out: got as far as "router" but never saw "#"`, pm.Error())
+	}
+
+	sh.SetPrompt("router#")
+	_, _, err = sh.Retrieve()
+	assert.Equal(t, &cliexpect.PartialMatchError{Err: asPartial(err).Err, Offset: 4, Matched: "router", Missing: "#"}, err)
+
+	_, err = sh.ReadUntil("uter>>", time.Millisecond)
+	assert.Equal(t, &cliexpect.PartialMatchError{Err: asPartial(err).Err, Offset: 6, Matched: "uter", Missing: ">>"}, err)
+	// Nothing partially matched is a plain timeout
+	_, err = sh.ReadUntil("--END--", time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, new(cliexpect.PartialMatchError), asPartial(err))
+}
+
+// asPartial returns err as a PartialMatchError, or an empty one if it isn't one
+func asPartial(err error) *cliexpect.PartialMatchError {
+	if pm, ok := err.(*cliexpect.PartialMatchError); ok {
+		return pm
+	}
+	return new(cliexpect.PartialMatchError)
+}
+
+func TestExpectPromptChange(t *testing.T) {
+	data := "\nrouter#\nEnter configuration commands\nrouter(config)#\nrouter(config)#"
+	sh := cliexpect.New(new(writer), &blockingReader{data: data})
+	sh.SetPromptRegex(`\S+#`)
+
+	_, _, err := sh.Retrieve()
+	assert.NoError(t, err)
+
+	oldPrompt, newPrompt, err := sh.ExpectPromptChange(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "router#", oldPrompt)
+	assert.Equal(t, "router(config)#", newPrompt)
+
+	oldPrompt, newPrompt, err = sh.ExpectPromptChange(time.Second)
+	assert.Equal(t, cliexpect.ErrPromptUnchanged, err)
+	assert.Equal(t, "router(config)#", oldPrompt)
+	assert.Equal(t, "router(config)#", newPrompt)
+}
+
+type closer struct {
+	writer
+	closed int
+}
+
+func (c *closer) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	c := new(closer)
+	sh := cliexpect.New(c, new(blockingReader))
+	sh.SetPromptRegex(`\S+[#>]`)
+	sh.RegisterTeardown("end")
+	sh.RegisterTeardown("exit")
+	sh.FeedForTest("\nrouter#\n\nrouter>")
+
+	assert.NoError(t, sh.Close())
+	assert.Equal(t, []byte("exit\n"), c.data)
+	assert.Equal(t, 1, c.closed)
+}
+
+func TestCloseTeardownFailure(t *testing.T) {
+	c := new(closer)
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(c, new(blockingReader), param)
+	sh.RegisterTeardown("exit")
+
+	assert.Error(t, sh.Close())
+	assert.Equal(t, 1, c.closed)
+}
+
+func TestPromptConfirmWindow(t *testing.T) {
+	param := cliexpect.ShellParam{PromptConfirmWindow: 100 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	// Prompt-like line in the middle of the output
+	sh.FeedForTest("out\nrouter#")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		full, groups, err := sh.Retrieve()
+		assert.NoError(t, err)
+		assert.Equal(t, "out\nrouter#\nmore\nrouter#", full)
+		assert.Equal(t, []string{"out\nrouter#\nmore\n", "router#"}, groups)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	sh.FeedForTest("\nmore\nrouter#")
+	<-done
+}
+
+func TestSendTemplate(t *testing.T) {
+	w := new(writer)
+	sh := cliexpect.New(w, new(blockingReader))
+
+	assert.NoError(t, sh.SendTemplate("show interface {{.intf}}", map[string]string{"intf": "eth0"}))
+	assert.Equal(t, []byte("show interface eth0\n"), w.data)
+
+	err := sh.SendTemplate("show interface {{.intf", nil)
+	assert.IsType(t, &cliexpect.TemplateError{}, err)
+	err = sh.SendTemplate("show interface {{.intf}}", map[string]string{})
+	assert.IsType(t, &cliexpect.TemplateError{}, err)
+}
+
+func TestRetrieveLimited(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: "summary\nlots more\nrouter#\nok\nrouter#"})
+	sh.SetPromptRegex(`\S+#`)
+
+	full, groups, truncated, err := sh.RetrieveLimited(8)
+	assert.NoError(t, err)
+	assert.True(t, truncated)
+	assert.Equal(t, "summary\nrouter#", full)
+	assert.Equal(t, []string{"summary\n", "router#"}, groups)
+
+	full, groups, truncated, err = sh.RetrieveLimited(8)
+	assert.NoError(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, "\nok\nrouter#", full)
+	assert.Equal(t, []string{"\nok\n", "router#"}, groups)
+}
+
+func TestAtEOF(t *testing.T) {
+	sh := cliexpect.New(new(writer), iotest.DataErrReader(strings.NewReader("test\nrouter#")))
+	sh.SetPromptRegex(`\S+#`)
+
+	_, _, err := sh.Retrieve()
+	if err != io.EOF && err != nil {
+		t.Fail()
+	}
+	assert.True(t, sh.AtEOF())
+
+	assert.False(t, cliexpect.New(new(writer), new(blockingReader)).AtEOF())
+}
+
+type scriptedShell struct {
+	lock      sync.Mutex
+	sh        *cliexpect.Shell
+	responses []string
+}
+
+func (w *scriptedShell) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.responses) > 0 {
+		w.sh.FeedForTest(w.responses[0])
+		w.responses = w.responses[1:]
+	}
+	return len(b), nil
+}
+
+// pipeShell answers each line written to it with the matching response through a pipe
+type pipeShell struct {
+	w         *io.PipeWriter
+	responses map[string]string
+}
+
+func (p *pipeShell) Write(b []byte) (int, error) {
+	if resp, ok := p.responses[string(b)]; ok {
+		go p.w.Write([]byte(resp))
+	}
+	return len(b), nil
+}
+
+func TestRun(t *testing.T) {
+	r, w := io.Pipe()
+	in := &pipeShell{w: w, responses: map[string]string{
+		"\n":             "\nrouter#",
+		"show version\n": "show version\nVersion 1.2\nrouter#",
+	}}
+
+	match, err := cliexpect.Run(in, r, `\S+#`, "show version", `Version (\S+)`, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Version 1.2", "1.2", "router#"}, match.Groups)
+	assert.Equal(t, "router#", match.Prompt)
+	// The Shell closed the reader on the way out
+	_, err = w.Write([]byte("x"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	r, w = io.Pipe()
+	in.w = w
+	_, err = cliexpect.Run(in, r, `\S+#`, "show bogus", `Version (\S+)`, 10*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestExpectTo(t *testing.T) {
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	w := new(syncBuilder)
+
+	done := make(chan error)
+	go func() {
+		done <- sh.ExpectTo(w, `\S+>`, time.Second)
+	}()
+	// Complete lines are streamed before the prompt arrives, and the partial line is held back
+	sh.FeedForTest("a\nrouter#\npar")
+	for i := 0; i < 100 && w.String() == ""; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, "a\nrouter#\n", w.String())
+	sh.FeedForTest("tial\nrouter>\nnext\nrouter#")
+	assert.NoError(t, <-done)
+	assert.Equal(t, "a\nrouter#\npartial\n", w.String())
+	assert.Equal(t, "router>", sh.LastPrompt())
+
+	// The rest is left for the next operation with the shell's own prompt
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\nnext\n", "router#"}, groups)
+
+	sh.FeedForTest("more\n")
+	assert.Error(t, sh.ExpectTo(w, `\S+>`, time.Millisecond))
+	assert.Equal(t, "a\nrouter#\npartial\nmore\n", w.String())
+}
+
+func TestExpectSkipped(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("Loading...\nrouter#\nstatus: OK (3 checks)\nrest")
+
+	skipped, match, err := sh.ExpectSkipped(cliexpect.RegexMatcher(`^status: OK \((\d+) checks\)$`), time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, "Loading...\nrouter#\n", skipped)
+	assert.Equal(t, "Loading...\nrouter#\nstatus: OK (3 checks)", match.Full)
+	assert.Equal(t, []string{"status: OK (3 checks)", "3"}, match.Groups)
+	assert.Equal(t, 5, sh.BufferedLen())
+
+	_, _, err = sh.ExpectSkipped(cliexpect.StrMatcher("OK"), time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestSentinel(t *testing.T) {
+	w := new(writer)
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(w, new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+
+	sentinel, err := sh.SendLineSentinel("cat motd")
+	assert.NoError(t, err)
+	other, _ := sh.SendLineSentinel("cat motd")
+	assert.NotEqual(t, sentinel, other)
+	sent := strings.SplitAfter(string(w.data), "\n")[0]
+	assert.NotContains(t, sent, sentinel)
+
+	// The echoed command and a prompt in the output are not mistaken for the end
+	sh.FeedForTest(sent + "banner\nrouter#\n")
+	_, err = sh.ExpectSentinel(sentinel)
+	assert.Error(t, err)
+	sh.FeedForTest(sentinel + "\r\nrouter#")
+	match, err := sh.ExpectSentinel(sentinel)
+	assert.NoError(t, err)
+	assert.Equal(t, sent+"banner\nrouter#\n", match.Body)
+	assert.Equal(t, "", match.Prompt)
+
+	// Prompt is left for the next operation
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "router#"}, groups)
+}
+
+func TestReconfigurePrompt(t *testing.T) {
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+
+	// Stale data delimited by the old prompt is absorbed into the transition, and nothing past the
+	// new prompt is consumed
+	sh.FeedForTest("leftover\nrouter#\nconfigure terminal\nrouter(config)#\nok\nrouter(config)#")
+	match, err := sh.ReconfigurePrompt(`\S+\(config\)#`, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, "leftover\nrouter#\nconfigure terminal\n", match.Body)
+	assert.Equal(t, "router(config)#", match.Prompt)
+	assert.Equal(t, "router(config)#", sh.LastPrompt())
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\nok\n", "router(config)#"}, groups)
+
+	// The new prompt applies even when it isn't found, and the buffer is kept
+	sh.FeedForTest("end\nrouter#")
+	_, err = sh.ReconfigurePrompt(`\S+>`, time.Millisecond)
+	assert.Error(t, err)
+	sh.FeedForTest("\nrouter>")
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"end\nrouter#\n", "router>"}, groups)
+}
+
+// keepaliveShell finishes a command after a number of keepalives, answering each with a bare prompt
+type keepaliveShell struct {
+	lock       sync.Mutex
+	sh         *cliexpect.Shell
+	keepalives []string
+	remaining  int
+}
+
+func (w *keepaliveShell) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.keepalives = append(w.keepalives, string(b))
+	if w.remaining--; w.remaining == 0 {
+		w.sh.FeedForTest("\noutput\nrouter#" + strings.Repeat("\nrouter#", len(w.keepalives)))
+	}
+	return len(b), nil
+}
+
+func TestKeepalive(t *testing.T) {
+	w := &keepaliveShell{remaining: 3}
+	param := cliexpect.ShellParam{Timeout: time.Second, KeepaliveInterval: 5 * time.Millisecond,
+		KeepaliveData: []byte("\x00")}
+	sh := cliexpect.NewWithParam(w, new(blockingReader), param)
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\noutput\n", "router#"}, groups)
+	w.lock.Lock()
+	assert.Equal(t, []string{"\x00", "\x00", "\x00"}, w.keepalives)
+	w.lock.Unlock()
+
+	// The bare prompts the keepalives caused are never returned as responses
+	sh.FeedForTest("\nnext\nrouter#")
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\nnext\n", "router#"}, groups)
+}
+
+func TestKeepaliveDisconnect(t *testing.T) {
+	r, w := io.Pipe()
+	param := cliexpect.ShellParam{Timeout: 30 * time.Millisecond, KeepaliveInterval: 5 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	sh.SetPromptRegex(`\S+#`)
+
+	// Unanswered keepalives leave bare prompts expected
+	_, _, err := sh.Retrieve()
+	assert.Error(t, err)
+	w.CloseWithError(errReset)
+	time.Sleep(10 * time.Millisecond)
+
+	// The reset is reported even if it is seen while skipping the bare prompts
+	_, _, err = sh.Retrieve()
+	assert.Equal(t, &cliexpect.DisconnectedError{Err: errReset}, err)
+}
+
+func TestExpectRetry(t *testing.T) {
+	w := &scriptedShell{responses: []string{"", "busy\nrouter#", "ready\nrouter#"}}
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(w, new(blockingReader), param)
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+
+	match, err := sh.ExpectRetry("status", cliexpect.StrMatcher("ready"), 3, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, cliexpect.Match{Full: "ready\nrouter#", Groups: []string{"ready", "router#"},
+		Body: "ready\n", Prompt: "router#"}, match)
+}
+
+func TestExpectRetryFailure(t *testing.T) {
+	param := cliexpect.ShellParam{Timeout: 1 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+
+	_, err := sh.ExpectRetry("status", cliexpect.StrMatcher("ready"), 2, time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	param := cliexpect.ShellParam{NormalizeUnicode: true}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPrompt("rout\u00e9#")                // Composed
+	sh.FeedForTest("cafe\u0301\nroute\u0301#") // Decomposed
+
+	full, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "caf\u00e9\nrout\u00e9#", full)
+	assert.Equal(t, []string{"caf\u00e9\n", "rout\u00e9#"}, groups)
+}
+
+func TestExpectOrError(t *testing.T) {
+	data := "ok\nrouter#\n% Invalid input\nrouter#\nSITE-FAIL 42\nrouter#"
+	sh := cliexpect.New(new(writer), &blockingReader{data: data})
+	sh.SetPromptRegex(`\S+#`)
+	sh.RegisterErrorPatterns(cliexpect.RegexMatcher(`SITE-FAIL \d+`))
+
+	match, err := sh.ExpectOrError(cliexpect.StrMatcher("ok"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ok", "router#"}, match.Groups)
+
+	_, err = sh.ExpectOrError(cliexpect.StrMatcher("ok"))
+	assert.Equal(t, &cliexpect.CommandError{Text: "% Invalid input", Body: "\n% Invalid input\n", Prompt: "router#"}, err)
+
+	_, err = sh.ExpectOrError(cliexpect.StrMatcher("ok"))
+	assert.Equal(t, &cliexpect.CommandError{Text: "SITE-FAIL 42", Body: "\nSITE-FAIL 42\n", Prompt: "router#"}, err)
+}
+
+func TestPendingPrompts(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	assert.Equal(t, 0, sh.PendingPrompts())
+
+	sh.FeedForTest("one\nrouter#\ntwo\nrouter#\npartial")
+	assert.Equal(t, 2, sh.PendingPrompts())
+	_, _, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sh.PendingPrompts())
+}
+
+func TestBufferedLen(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	assert.Equal(t, 0, sh.BufferedLen())
+
+	sh.FeedForTest("one\nrouter#\npartial")
+	assert.Equal(t, 19, sh.BufferedLen())
+	_, _, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, len("\npartial"), sh.BufferedLen())
+}
+
+func TestStrictPrompt(t *testing.T) {
+	param := cliexpect.ShellParam{StrictPrompt: true, Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("a\nrouter#\nb\nrouter#")
+	assert.Equal(t, 1, sh.PendingPrompts())
+
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a\nrouter#\nb\n", "router#"}, groups)
+
+	sh.FeedForTest("c\nrouter#\npartial")
+	_, _, err = sh.Retrieve()
+	assert.Error(t, err)
+}
+
+func TestLastPromptWins(t *testing.T) {
+	param := cliexpect.ShellParam{LastPromptWins: true, Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("a\nrouter#\nb\nrouter#\npartial")
+
+	// Unlike StrictPrompt, data after the last prompt doesn't prevent a match
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a\nrouter#\nb\n", "router#"}, groups)
+
+	// Literal prompts too
+	sh.SetPrompt("router#")
+	sh.FeedForTest("\nrouter#\nc\nrouter#")
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\npartial\nrouter#\nc\n", "router#"}, groups)
+}
+
+func TestPromptBlankLines(t *testing.T) {
+	param := cliexpect.ShellParam{PromptBlankLines: 2, Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("a\nrouter#\n\nb#\n \r\n\nrouter#")
+
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a\nrouter#\n\nb#\n", "router#"}, groups)
+
+	sh.SetPrompt("router#")
+	sh.FeedForTest("\nc\n\nrouter#")
+	_, _, err = sh.Retrieve()
+	assert.Error(t, err)
+	sh.FeedForTest("\n\n\nrouter#")
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\nc\n\nrouter#\n", "router#"}, groups)
+}
+
+func TestTrimLeadingNewlineAndPromptSpace(t *testing.T) {
+	// Same input as the package example
+	input := `user@host:~$ 
+test.py: ASCII text
+user@host:~$ `
+
+	param := cliexpect.ShellParam{TrimLeadingNewline: true, TrimPromptSpace: true}
+	sh := cliexpect.NewWithParam(new(writer), strings.NewReader(input), param)
+	sh.SetPromptRegex(`\w+@\w+:\S+\$ `)
+
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "user@host:~$"}, groups)
+	full, groups, err := sh.ExpectRegex(".*test.py.*")
+	if err != io.EOF {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, "test.py: ASCII text\nuser@host:~$ ", full)
+	assert.Equal(t, []string{"test.py: ASCII text\n", "user@host:~$"}, groups)
+	assert.Equal(t, "user@host:~$", sh.LastPrompt())
+
+	// Only a single line ending is removed
+	sh = cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("\r\n\nok\nrouter#")
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\nok\n", "router#"}, groups)
+}
+
+func TestExpectFunc(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: "10.0.0.1\nrouter#\n10.0.0.2\nrouter#"})
+	sh.SetPromptRegex(`\S+#`)
+
+	body, err := sh.ExpectFunc(func(body string) bool {
+		return strings.Count(body, "10.0.0.") >= 2
+	}, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1\n\n10.0.0.2\n", body)
+
+	body, err = sh.ExpectFunc(func(string) bool { return true }, 10*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, "", body)
+}
+
+func TestChannelSize(t *testing.T) {
+	data := "test\nrouter#"
+	param := cliexpect.ShellParam{ChannelSize: 1}
+	sh := cliexpect.NewWithParam(new(writer), iotest.OneByteReader(strings.NewReader(data)), param)
+	sh.SetPromptRegex(`\S+#`)
+
+	full, _, err := sh.Retrieve()
+	if err != io.EOF && err != nil {
+		t.Fail()
+	}
+	assert.Equal(t, data, full)
+}
+
+func TestConfirm(t *testing.T) {
+	w := new(writer)
+	sh := cliexpect.New(w, new(blockingReader))
+	sh.FeedForTest("Erase flash? [y/n]: ")
+
+	assert.NoError(t, sh.ConfirmYes(`\[y/n\]: `))
+	assert.Equal(t, []byte("y\n"), w.data)
+
+	sh.FeedForTest("Really? [y/n]: ")
+	assert.NoError(t, sh.ConfirmNo(`\[y/n\]: `))
+	assert.Equal(t, []byte("n\n"), w.data)
+}
+
+func TestConfirmNoPrompt(t *testing.T) {
+	w := new(writer)
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(w, new(blockingReader), param)
+
+	assert.Error(t, sh.ConfirmYes(`\[y/n\]: `))
+	assert.Nil(t, w.data)
+}
+
+func TestExpectJoined(t *testing.T) {
+	data := "Interface eth0\nrouter#\nStatus: up\nrouter#\nunrelated\nrouter#"
+	sh := cliexpect.New(new(writer), &blockingReader{data: data})
+	sh.SetPromptRegex(`\S+#`)
+
+	match, err := sh.ExpectJoined(cliexpect.RegexMatcher(`eth0.*Status: (\w+)`), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, cliexpect.Match{Full: "Interface eth0\n\nStatus: up\nrouter#",
+		Groups: []string{"eth0\n\nStatus: up", "up", "router#"}, Body: "Interface eth0\n\nStatus: up\n",
+		Prompt: "router#"}, match)
+
+	_, err = sh.ExpectJoined(cliexpect.StrMatcher("missing"), 1)
+	assert.Equal(t, &cliexpect.BodyMismatchError{Body: "\nunrelated\n", Prompt: "router#"}, err)
+}
+
+func TestCloseWaitsForReader(t *testing.T) {
+	r, w := io.Pipe()
+	sh := cliexpect.New(new(writer), r)
+	go w.Write([]byte("data"))
+
+	assert.NoError(t, sh.Close())
+	done := make(chan struct{})
+	go func() {
+		sh.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Reader still running after Close")
+	}
+}
+
+func TestClosePaused(t *testing.T) {
+	r, _ := io.Pipe()
+	sh := cliexpect.New(new(writer), r)
+	sh.Pause()
+
+	assert.NoError(t, sh.Close())
+	sh.Wait()
+}
+
+func TestNULHandling(t *testing.T) {
+	data := "te\x00st\nrouter#"
+
+	tests := []struct {
+		name   string
+		mode   cliexpect.NULMode
+		groups []string
+		err    error
+	}{
+		{"PassThrough", cliexpect.NULPassThrough, []string{"te\x00st\n", "router#"}, nil},
+		{"Strip", cliexpect.NULStrip, []string{"test\n", "router#"}, nil},
+		{"Error", cliexpect.NULError, nil, cliexpect.ErrNULByte},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			param := cliexpect.ShellParam{NULHandling: test.mode}
+			sh := cliexpect.NewWithParam(new(writer), &blockingReader{data: data}, param)
+			sh.SetPromptRegex(`\S+#`)
+
+			_, groups, err := sh.Retrieve()
+			assert.Equal(t, test.err, err)
+			assert.Equal(t, test.groups, groups)
+		})
+	}
+}
+
+func TestPreBufferedNoWait(t *testing.T) {
+	// Any wait at all would time out, so a nil error proves there was no wait
+	param := cliexpect.ShellParam{Timeout: 1 * time.Nanosecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("test\nrouter#\nother\nrouter#")
+	// Acknowledge the feed notification so the buffer is all that's left
+	_, err := sh.ReadUntil("test", time.Second)
+	assert.NoError(t, err)
+
+	_, groups, err := sh.ExpectStr("\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\n", "router#"}, groups)
+
+	_, _, err = sh.ExpectStr("missing")
+	assert.Equal(t, &cliexpect.BodyMismatchError{Body: "\nother\n", Prompt: "router#"}, err)
+}
+
+func TestExpectAny(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	errRe, okRe := cliexpect.RegexMatcher(`% Error: ([^\n]*)`), cliexpect.RegexMatcher(`Commit complete`)
+
+	// Both in the same data, so the error wins despite arriving second
+	sh.FeedForTest("\nCommit complete\n% Error: disk full\nrouter#")
+	idx, match, err := sh.ExpectAny(time.Second, errRe, okRe)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, idx)
+	assert.Equal(t, []string{"% Error: disk full", "disk full"}, match.Groups)
+	assert.Equal(t, "\nrouter#", sh.Snapshot().Buffered())
+
+	sh.FeedForTest("\nCommit complete\nrouter#")
+	idx, match, err = sh.ExpectAny(time.Second, errRe, okRe)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, idx)
+	assert.Equal(t, "\nrouter#\nCommit complete", match.Full)
+
+	idx, _, err = sh.ExpectAny(10*time.Millisecond, errRe, okRe)
+	assert.Error(t, err)
+	assert.Equal(t, -1, idx)
+}
+
+func TestReadN(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: "0005hellorest"})
+
+	length, err := sh.ReadN(4, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "0005", length)
+	payload, err := sh.ReadN(5, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", payload)
+
+	data, err := sh.ReadN(5, 10*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, "", data)
+	data, err = sh.ReadN(4, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "rest", data)
+
+	_, err = sh.ReadN(-1, time.Second)
+	assert.Error(t, err)
+}
+
+func TestExpectFrame(t *testing.T) {
+	param := cliexpect.ShellParam{Timeout: 20 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	length := func(header []byte) int { return int(header[1]) }
+
+	sh.FeedForTest("\x01\x03abc\x02\x04de")
+	frame, err := sh.ExpectFrame(2, length)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x01\x03abc"), frame)
+
+	// An incomplete frame times out without being consumed
+	frame, err = sh.ExpectFrame(2, length)
+	assert.Error(t, err)
+	assert.Nil(t, frame)
+	sh.FeedForTest("fg")
+	frame, err = sh.ExpectFrame(2, length)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x02\x04defg"), frame)
+
+	sh.FeedForTest("\x03\x00")
+	_, err = sh.ExpectFrame(2, func([]byte) int { return -1 })
+	assert.Error(t, err)
+	frame, err = sh.ExpectFrame(2, length)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x03\x00"), frame)
+
+	_, err = sh.ExpectFrame(-1, length)
+	assert.Error(t, err)
+}
+
+func TestLastPrompt(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: "test\nrouter#\nrouter(config)#"})
+	sh.SetPromptRegex(`\S+#`)
+	assert.Equal(t, "", sh.LastPrompt())
+
+	_, _, err := sh.ExpectStr("test")
+	assert.NoError(t, err)
+	assert.Equal(t, "router#", sh.LastPrompt())
+	_, _, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "router(config)#", sh.LastPrompt())
+}
+
+func TestSetPromptAnchor(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: "result=42 > more\x1b> "})
+	sh.SetPromptAnchor(`\x1b`, "")
+	sh.SetPrompt("> ")
+
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"result=42 > more", "> "}, groups)
+}
+
+func TestWithBudget(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: "ok\nrouter#"})
+	sh.SetPromptRegex(`\S+#`)
+
+	err := sh.WithBudget(50*time.Millisecond, func(sh *cliexpect.Shell) error {
+		if err := sh.SendLine("show"); err != nil {
+			return err
+		}
+		if _, _, err := sh.ExpectStr("ok"); err != nil {
+			return err
+		}
+		// Default timeout is 10s, but the budget cuts it short
+		start := time.Now()
+		_, _, err := sh.Retrieve()
+		assert.True(t, time.Since(start) < time.Second)
+		assert.Error(t, err)
+		return sh.SendLine("too late")
+	})
+	assert.Equal(t, cliexpect.ErrBudgetExpired, err)
+	// Budget no longer applies
+	assert.NoError(t, sh.SendLine("show"))
+}
+
+func TestExpectScanf(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: "\nTemperature: 42 C\nrouter#\nbogus\nrouter#"})
+	sh.SetPromptRegex(`\S+#`)
+
+	var temp int
+	var unit string
+	assert.NoError(t, sh.ExpectScanf("Temperature: %d %s", &temp, &unit))
+	assert.Equal(t, 42, temp)
+	assert.Equal(t, "C", unit)
+
+	assert.Error(t, sh.ExpectScanf("Temperature: %d %s", &temp, &unit))
+}
+
+func TestSendInterrupt(t *testing.T) {
+	w := &scriptedShell{responses: []string{"^C\nrouter#"}}
+	sh := cliexpect.New(w, new(blockingReader))
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("partial output\n")
+
+	match, err := sh.SendInterrupt()
+	assert.NoError(t, err)
+	assert.Equal(t, "partial output\n^C\n", match.Body)
+	assert.Equal(t, "router#", match.Prompt)
+	assert.Equal(t, []string{"partial output\n^C\n", "router#"}, match.Groups)
+}
+
+func TestExpectIndices(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("uptime is 5 days\nrouter#")
+
+	body, indices, err := sh.ExpectIndices(cliexpect.RegexMatcher(`(\d+) days`))
+	assert.NoError(t, err)
+	assert.Equal(t, "uptime is 5 days\n", body)
+	assert.Equal(t, []int{10, 16, 10, 11}, indices)
+	assert.Equal(t, "5", body[indices[2]:indices[3]])
+}
+
+func TestFailFastAfterEOF(t *testing.T) {
+	sh := cliexpect.New(new(writer), iotest.DataErrReader(strings.NewReader("test\nrouter#")))
+	sh.SetPromptRegex(`\S+#`)
+	_, _, err := sh.Retrieve()
+	assert.Equal(t, io.EOF, err)
+
+	// The EOF was already reported, so this must not wait out the timeout
+	start := time.Now()
+	_, _, err = sh.Retrieve()
+	assert.Equal(t, cliexpect.ErrNoMatches, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestEchoOnPromptLine(t *testing.T) {
+	param := cliexpect.ShellParam{EchoOnPromptLine: true}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("router# show version\r\nVersion 1.0\nrouter#")
+
+	full, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "Version 1.0\nrouter#", full)
+	assert.Equal(t, []string{"Version 1.0\n", "router#"}, groups)
+}
+
+func TestExpectMapRegex(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("Gi0/1 up\nGi0/2 down\nGi0/1 admin-down\nrouter#")
+
+	results, err := sh.ExpectMapRegex(`^(\S+) (\S+)$`, 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Gi0/1": "admin-down", "Gi0/2": "down"}, results)
+
+	_, err = sh.ExpectMapRegex(`(\S+)`, 1, 2)
+	assert.Error(t, err)
+
+	sh.FeedForTest("nothing\nrouter#")
+	_, err = sh.ExpectMapRegex(`^(\d+) (\d+)$`, 1, 2)
+	assert.Equal(t, cliexpect.ErrNoMatches, err)
+}
+
+func TestExpectCapture(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("Version 1.2 (build 7)\nrouter#")
+
+	_, err := sh.ExpectCapture(`Version (\S+)`, 2, time.Millisecond)
+	assert.Error(t, err)
+	version, err := sh.ExpectCapture(`Version (\S+) \(build (\d+)\)`, 2, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, "7", version)
+
+	sh.FeedForTest("bogus\nrouter#")
+	_, err = sh.ExpectCapture(`Version (\S+)`, 1, time.Millisecond)
+	assert.IsType(t, &cliexpect.BodyMismatchError{}, err)
+}
+
+func TestExpectLines(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+
+	sh.FeedForTest("\r\nGi0/1 up\r\n\r\nGi0/2 down\r\nrouter#")
+	lines, err := sh.ExpectLines(cliexpect.StrMatcher("Gi0/1"), time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Gi0/1 up", "", "Gi0/2 down"}, lines)
+
+	sh.FeedForTest("\nrouter#")
+	lines, err = sh.ExpectLines(cliexpect.RegexMatcher(""), time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, lines)
+
+	sh.FeedForTest("bogus\nrouter#")
+	lines, err = sh.ExpectLines(cliexpect.StrMatcher("Gi0/1"), time.Millisecond)
+	assert.Error(t, err)
+	assert.Nil(t, lines)
+}
+
+func TestRegisterBackgroundTask(t *testing.T) {
+	w := new(syncBuilder)
+	sh := cliexpect.New(w, new(blockingReader))
+	ticks := make(chan struct{})
+	sh.RegisterBackgroundTask(func(stop <-chan struct{}) {
+		for {
+			select {
+			case <-ticks:
+				sh.SendLine("")
+			case <-stop:
+				w.Write([]byte("stopped"))
+				return
+			}
+		}
+	})
+	ticks <- struct{}{}
+	assert.NoError(t, sh.Close())
+	// Close must not return until the task has
+	assert.Equal(t, "\nstopped", w.String())
+}
+
+func TestExpectEmptyBody(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest(" \nrouter#\noops\nrouter#")
+
+	assert.NoError(t, sh.ExpectEmptyBody(time.Second))
+	err := sh.ExpectEmptyBody(time.Second)
+	assert.Equal(t, &cliexpect.UnexpectedBodyError{Body: "\noops\n", Prompt: "router#"}, err)
+}
+
+func TestExpectEmptyBodyStrict(t *testing.T) {
+	param := cliexpect.ShellParam{StrictEmptyBody: true}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("\nrouter#")
+
+	assert.IsType(t, &cliexpect.UnexpectedBodyError{}, sh.ExpectEmptyBody(time.Second))
+}
+
+func TestSetSplitFunc(t *testing.T) {
+	param := cliexpect.ShellParam{StrictPrompt: true}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	// The prompt is everything after the last blank line
+	sh.SetSplitFunc(func(buffered string) (int, int, bool) {
+		idx := strings.LastIndex(buffered, "\n\n")
+		if idx < 0 || !strings.HasSuffix(buffered, ">") {
+			return 0, 0, false
+		}
+		return idx + 2, len(buffered), true
+	})
+	sh.FeedForTest("line 1\nline 2\n\nmy prompt>")
+
+	full, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "line 1\nline 2\n\nmy prompt>", full)
+	assert.Equal(t, []string{"line 1\nline 2\n\n", "my prompt>"}, groups)
+
+	sh.SetSplitFunc(nil)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("ok\nrouter#")
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ok\n", "router#"}, groups)
+}
+
+func TestExpectStable(t *testing.T) {
+	w := &scriptedShell{responses: []string{"1\nr#", "2\nr#", "2\nr#", "3\nr#", "3\nr#", "3\nr#"}}
+	sh := cliexpect.New(w, new(blockingReader))
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+
+	body, err := sh.ExpectStable("show routes", 3, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, "3\n", body)
+	assert.Empty(t, w.responses)
+}
+
+func TestExpectStableBudget(t *testing.T) {
+	w := &scriptedShell{responses: []string{"1\nr#", "2\nr#", "3\nr#"}}
+	sh := cliexpect.New(w, new(blockingReader))
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+
+	err := sh.WithBudget(50*time.Millisecond, func(sh *cliexpect.Shell) error {
+		_, err := sh.ExpectStable("show routes", 2, 10*time.Millisecond)
+		return err
+	})
+	assert.Error(t, err)
+}
+
+func TestSyncPrompt(t *testing.T) {
+	w := &scriptedShell{responses: []string{"\nrouter#\nrouter(config)#"}}
+	sh := cliexpect.New(w, new(blockingReader))
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("stale output")
+
+	prompt, err := sh.SyncPrompt(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "router(config)#", prompt)
+	assert.Equal(t, "router(config)#", sh.LastPrompt())
+	assert.Equal(t, 0, sh.PendingPrompts())
+}
+
+func TestPing(t *testing.T) {
+	w := &scriptedShell{responses: []string{"\nrouter#"}}
+	sh := cliexpect.New(w, new(blockingReader))
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("old\nrouter#")
+
+	assert.NoError(t, sh.Ping(time.Second))
+	// No answer this time, and the old prompt it discarded can't stand in for one
+	sh.FeedForTest("old\nrouter#")
+	assert.Error(t, sh.Ping(10*time.Millisecond))
+}
+
+func TestPingAfterReset(t *testing.T) {
+	sh := cliexpect.New(new(writer), &resetReader{data: "old\nrouter#"})
+	sh.SetPromptRegex(`\S+#`)
+
+	// The reset is reported instead of waiting out the timeout
+	start := time.Now()
+	err := sh.Ping(5 * time.Second)
+	assert.IsType(t, &cliexpect.DisconnectedError{}, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestIgnorePromptCase(t *testing.T) {
+	param := cliexpect.ShellParam{IgnorePromptCase: true}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPrompt("router#")
+
+	sh.FeedForTest("\nshow ver\nRouter#")
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\nshow ver\n", "Router#"}, groups)
+
+	// The anchors are still case sensitive
+	sh.SetPromptAnchor(`^sw-`, `$`)
+	sh.FeedForTest("\nSW-ROUTER#")
+	_, ok := sh.TryRetrieve()
+	assert.False(t, ok)
+	sh.FeedForTest("\nsw-ROUTER#")
+	match, ok := sh.TryRetrieve()
+	assert.True(t, ok)
+	assert.Equal(t, "ROUTER#", match.Prompt)
+}
+
+func TestSkipToPrompt(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+
+	sh.FeedForTest("\nBuilding configuration...\nrouter#\nrouter(config)#")
+	assert.NoError(t, sh.SkipToPrompt(time.Second))
+	assert.Equal(t, "router#", sh.LastPrompt())
+	assert.NoError(t, sh.SkipToPrompt(time.Second))
+	assert.Equal(t, "router(config)#", sh.LastPrompt())
+	assert.Error(t, sh.SkipToPrompt(10*time.Millisecond))
+}
+
+func TestReturnToPrompt(t *testing.T) {
+	w := &scriptedShell{responses: []string{"\nrouter(config-if)#", "\nrouter(config)#", "\nrouter#"}}
+	sh := cliexpect.New(w, new(blockingReader))
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+
+	match, err := sh.ReturnToPrompt("exit", `router#`, 5, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "router#", match.Prompt)
+	assert.Empty(t, w.responses)
+
+	// Already there, so nothing is sent
+	match, err = sh.ReturnToPrompt("exit", `router#`, 5, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, cliexpect.Match{Prompt: "router#"}, match)
+
+	w.responses = []string{"\nswitch(config)#", "\nswitch(config)#"}
+	_, err = sh.ReturnToPrompt("exit", `switch#`, 2, time.Second)
+	assert.Equal(t, &cliexpect.UnexpectedPromptError{Body: "\n", Prompt: "switch(config)#"}, err)
+}
+
+func TestLinesUntilPrompt(t *testing.T) {
+	r, w := io.Pipe()
+	sh := cliexpect.New(new(writer), r)
+	sh.SetPromptRegex(`\S+#`)
+
+	lines, wait := sh.LinesUntilPrompt()
+	w.Write([]byte("\nline one\r\nline "))
+	assert.Equal(t, "line one", <-lines)
+	w.Write([]byte("two\r\nrouter#"))
+	assert.Equal(t, "line two", <-lines)
+	_, ok := <-lines
+	assert.False(t, ok)
+	assert.NoError(t, wait())
+	assert.Equal(t, "router#", sh.LastPrompt())
+	assert.Equal(t, 0, sh.BufferedLen())
+
+	// The partial line before the prompt is delivered, but not the prompt
+	sh.SetPromptAnchor("", "$")
+	lines, wait = sh.LinesUntilPrompt()
+	w.Write([]byte("\nfirst\nsecond router#"))
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+	assert.Equal(t, []string{"first", "second "}, got)
+	assert.NoError(t, wait())
+}
+
+func TestLinesUntilPromptError(t *testing.T) {
+	sh := cliexpect.New(new(writer), &resetReader{data: "\nline one\nline"})
+	sh.SetPromptRegex(`\S+#`)
+
+	lines, wait := sh.LinesUntilPrompt()
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+	assert.Equal(t, []string{"line one"}, got)
+	assert.Equal(t, &cliexpect.DisconnectedError{Partial: "line", Err: errReset}, wait())
+	assert.Equal(t, 4, sh.BufferedLen())
+
+	param := cliexpect.ShellParam{PromptBlankLines: 1}
+	sh = cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	lines, wait = sh.LinesUntilPrompt()
+	_, ok := <-lines
+	assert.False(t, ok)
+	assert.Error(t, wait())
+}
+
+func TestLinesUntilPromptStop(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("\none\ntwo\nthree\nrouter#")
+
+	// Stopping after the first line leaves the shell usable, with the rest of the response buffered
+	lines, stop := sh.LinesUntilPrompt()
+	assert.Equal(t, "one", <-lines)
+	assert.Equal(t, cliexpect.ErrLinesStopped, stop())
+	_, ok := <-lines
+	assert.False(t, ok)
+	body, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "two\nthree\nrouter#", body)
+	assert.Equal(t, []string{"two\nthree\n", "router#"}, groups)
+}
+
+func TestLinesUntilPromptAbandoned(t *testing.T) {
+	r, w := io.Pipe()
+	sh := cliexpect.New(new(writer), r)
+	sh.SetPromptRegex(`\S+#`)
+
+	// Close must not wait on a channel nobody is reading anymore
+	lines, _ := sh.LinesUntilPrompt()
+	go w.Write([]byte("\none\ntwo\nthree\n"))
+	assert.Equal(t, "one", <-lines)
+	closed := make(chan error)
+	go func() { closed <- sh.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by an abandoned LinesUntilPrompt")
+	}
+}
+
+func TestExpectPromptIn(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+[#>]`)
+	sh.FeedForTest("ok\nrouter(config)#\nrouter>")
+
+	idx, match, err := sh.ExpectPromptIn(`router#`, `router\(config\)#`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, idx)
+	assert.Equal(t, "ok\n", match.Body)
+	assert.Equal(t, "router(config)#", match.Prompt)
+
+	// Must match the whole prompt
+	idx, _, err = sh.ExpectPromptIn(`router`, `router#`)
+	assert.Equal(t, -1, idx)
+	assert.Equal(t, &cliexpect.UnexpectedPromptError{Body: "\n", Prompt: "router>"}, err)
+}
+
+func TestAutoDetectPrompt(t *testing.T) {
+	w := &scriptedShell{responses: []string{"\nrouter-01#", "show version\nrouter-01>\nrouter-01#"}}
+	sh := cliexpect.New(w, new(blockingReader))
+	w.sh = sh
+
+	assert.NoError(t, sh.AutoDetectPrompt(time.Second))
+	assert.Equal(t, "router-01#", sh.LastPrompt())
+
+	// The exact prompt skips a line that would match the default prompt regex
+	assert.NoError(t, sh.SendLine("show version"))
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"show version\nrouter-01>\n", "router-01#"}, groups)
+}
+
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(b)
+}
+
+func TestSynchronousRead(t *testing.T) {
+	r := &countingReader{Reader: iotest.OneByteReader(strings.NewReader("test\nrouter#"))}
+	param := cliexpect.ShellParam{SynchronousRead: true}
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	sh.SetPromptRegex(`\S+#`)
+	// Without a reader goroutine, nothing is read until an operation needs the data
+	assert.Equal(t, 0, r.reads)
+
+	full, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "test\nrouter#", full)
+	assert.Equal(t, []string{"test\n", "router#"}, groups)
+	assert.Equal(t, len(full), r.reads)
+
+	_, _, err = sh.Retrieve()
+	assert.Equal(t, cliexpect.ErrNoMatches, err)
+	assert.NoError(t, sh.Close())
+}
+
+// endlessReader returns 5 bytes on every read, counting reads atomically
+type endlessReader struct {
+	reads int32
+}
+
+func (r *endlessReader) Read(b []byte) (int, error) {
+	atomic.AddInt32(&r.reads, 1)
+	return copy(b, "xxxxx"), nil
+}
+
+// waitUntil polls cond until it is true, failing the test if that takes more than a few seconds
+func waitUntil(t *testing.T, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition never met")
+		}
+	}
+}
+
+func TestHighWater(t *testing.T) {
+	r := new(endlessReader)
+	param := cliexpect.ShellParam{HighWater: 10, LowWater: 4}
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	// The chunk reaching HighWater stops the reader before it can read again, so the count is exact
+	waitUntil(t, func() bool { return sh.BufferedLen() == 10 })
+	assert.Equal(t, int32(2), atomic.LoadInt32(&r.reads))
+
+	// Consuming down to 5 bytes isn't enough, but 2 is
+	_, err := sh.ReadN(5, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&r.reads))
+	_, err = sh.ReadN(3, time.Millisecond)
+	assert.NoError(t, err)
+	waitUntil(t, func() bool { return sh.BufferedLen() == 12 })
+	assert.Equal(t, int32(4), atomic.LoadInt32(&r.reads))
+	assert.NoError(t, sh.Close())
+}
+
+func TestFail(t *testing.T) {
+	w := new(writer)
+	sh := cliexpect.New(w, new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.RegisterTeardown("exit")
+	rebooted := errors.New("Device rebooted")
+
+	// An operation already waiting is aborted
+	done := make(chan error)
+	go func() {
+		_, _, err := sh.Retrieve()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	sh.Fail(rebooted)
+	sh.Fail(errors.New("ignored"))
+	select {
+	case err := <-done:
+		assert.Equal(t, rebooted, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Retrieve not aborted")
+	}
+	assert.Equal(t, rebooted, sh.Failed())
+
+	// Later operations fail without any I/O, even with data buffered
+	sh.FeedForTest("ok\nrouter#")
+	_, _, err := sh.Retrieve()
+	assert.Equal(t, rebooted, err)
+	assert.Equal(t, rebooted, sh.SendLine("show"))
+	assert.Equal(t, rebooted, sh.SendRaw([]byte("x")))
+	_, err = sh.ReadAvailable()
+	assert.Equal(t, rebooted, err)
+	assert.NoError(t, sh.Close())
+	assert.Empty(t, w.data)
+}
+
+func TestExpectAbsent(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("all good\nrouter#\nline 1\nERROR: bad\nrouter#")
+
+	match, err := sh.ExpectAbsent(`ERROR.*$`, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "all good\n", match.Body)
+
+	_, err = sh.ExpectAbsent(`ERROR.*?$`, time.Second)
+	assert.Equal(t, &cliexpect.ForbiddenMatchError{Text: "ERROR: bad", Body: "\nline 1\nERROR: bad\n",
+		Prompt: "router#"}, err)
+}
+
+func TestExpectAfter(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("banner\nInterface  Status\n-----\nGi0/1 up\nGi0/2 down\nrouter#")
+
+	after, match, err := sh.ExpectAfter(`^(\S+)\s+Status\n-+\n`)
+	assert.NoError(t, err)
+	assert.Equal(t, "Gi0/1 up\nGi0/2 down\n", after)
+	assert.Equal(t, []string{"Interface  Status\n-----\n", "Interface", "router#"}, match.Groups)
+	assert.Equal(t, "router#", match.Prompt)
+
+	sh.FeedForTest("nothing\nrouter#")
+	_, _, err = sh.ExpectAfter(`Status`)
+	assert.Equal(t, cliexpect.ErrNoMatches, err)
+}
+
+// dribble writes the data to w one byte at a time, waiting delay between each
+func dribble(w io.Writer, data string, delay time.Duration) {
+	for i := 0; i < len(data); i++ {
+		time.Sleep(delay)
+		w.Write([]byte{data[i]})
+	}
+}
+
+// countAttempts retrieves a dribbled response and returns how many times the prompt was matched
+func countAttempts(t testing.TB, param cliexpect.ShellParam, data string, delay time.Duration) int {
+	r, w := io.Pipe()
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	var attempts int
+	sh.SetSplitFunc(func(buffered string) (int, int, bool) {
+		attempts++
+		if idx := strings.Index(buffered, "\nrouter#"); idx >= 0 {
+			return idx + 1, idx + 8, true
+		}
+		return 0, 0, false
+	})
+
+	go dribble(w, data, delay)
+	_, _, err := sh.Retrieve()
+	assert.NoError(t, err)
+	return attempts
+}
+
+// lockstepAttempts retrieves a response written one byte at a time, each only once the last is
+// buffered (and, if eachAttempt, matched against), and returns how many times the prompt was matched
+// and how long it took
+func lockstepAttempts(t *testing.T, param cliexpect.ShellParam, data string, eachAttempt bool) (int, time.Duration) {
+	r, w := io.Pipe()
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	var attempts int32
+	sh.SetSplitFunc(func(buffered string) (int, int, bool) {
+		atomic.AddInt32(&attempts, 1)
+		if idx := strings.Index(buffered, "\nrouter#"); idx >= 0 {
+			return idx + 1, idx + 8, true
+		}
+		return 0, 0, false
+	})
+
+	start, done := time.Now(), make(chan error)
+	go func() {
+		_, _, err := sh.Retrieve()
+		done <- err
+	}()
+	// There is always a first attempt on the empty buffer
+	waitUntil(t, func() bool { return atomic.LoadInt32(&attempts) >= 1 })
+	for i := 0; i < len(data); i++ {
+		w.Write([]byte{data[i]})
+		if i == len(data)-1 {
+			break
+		}
+		waitUntil(t, func() bool { return sh.BufferedLen() == i+1 })
+		if eachAttempt {
+			waitUntil(t, func() bool { return atomic.LoadInt32(&attempts) >= int32(i+2) })
+		}
+	}
+	assert.NoError(t, <-done)
+	return int(atomic.LoadInt32(&attempts)), time.Since(start)
+}
+
+func TestPollInterval(t *testing.T) {
+	data := strings.Repeat("x", 100) + "\nrouter#"
+	// Without a poll interval, every byte is a match attempt (the lockstep only proceeds once it is)
+	param := cliexpect.ShellParam{ChannelSize: 1024}
+	unlimited, _ := lockstepAttempts(t, param, data, true)
+	assert.True(t, unlimited > len(data))
+
+	// Attempts are at least the interval apart, however long the writes take
+	param.PollInterval = 20 * time.Millisecond
+	limited, elapsed := lockstepAttempts(t, param, data, false)
+	bound := int(elapsed/param.PollInterval) + 2
+	assert.True(t, limited <= bound, "%d attempts with poll interval in %v", limited, elapsed)
+}
+
+func TestPollIntervalNoLatency(t *testing.T) {
+	param := cliexpect.ShellParam{PollInterval: time.Hour}
+	sh := cliexpect.NewWithParam(new(writer), strings.NewReader("test\nrouter#"), param)
+	sh.SetPromptRegex(`\S+#`)
+
+	// The whole response arrives in one read after nothing was buffered, so it must match right away
+	_, groups, err := sh.Retrieve()
+	if err != io.EOF {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"test\n", "router#"}, groups)
+}
+
+// benchmarkDribble retrieves a response dribbled one byte at a time. Since the dribble sets the pace,
+// compare CPU time (ex: with -cpuprofile) rather than ns/op
+func benchmarkDribble(b *testing.B, param cliexpect.ShellParam) {
+	data := strings.Repeat("x", 256) + "\nrouter#"
+	param.ChannelSize = 1024
+	for i := 0; i < b.N; i++ {
+		countAttempts(b, param, data, 10*time.Microsecond)
+	}
+}
+
+func BenchmarkDribble(b *testing.B) {
+	benchmarkDribble(b, cliexpect.ShellParam{})
+}
+
+func BenchmarkDribblePollInterval(b *testing.B) {
+	benchmarkDribble(b, cliexpect.ShellParam{PollInterval: time.Millisecond})
+}
+
+// resetReader returns its data and then errReset
+type resetReader struct {
+	data string
+}
+
+var errReset = errors.New("Connection reset by peer")
+
+func (r *resetReader) Read(b []byte) (int, error) {
+	if r.data == "" {
+		return 0, errReset
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDisconnectedError(t *testing.T) {
+	sh := cliexpect.New(new(writer), &resetReader{data: "partial output\n"})
+	sh.SetPromptRegex(`\S+#`)
+
+	_, _, err := sh.Retrieve()
+	assert.Equal(t, &cliexpect.DisconnectedError{Partial: "partial output\n", Err: errReset}, err)
+}
+
+func TestDisconnectedErrorAfterFeed(t *testing.T) {
+	param := cliexpect.ShellParam{Timeout: time.Hour}
+	sh := cliexpect.NewWithParam(new(writer), &resetReader{data: "partial "}, param)
+	sh.SetPromptRegex(`\S+#`)
+
+	// The wakeup from the feed must not hide the error the reader already reported
+	sh.Wait()
+	sh.FeedForTest("output\n")
+	_, _, err := sh.Retrieve()
+	assert.Equal(t, &cliexpect.DisconnectedError{Partial: "partial output\n", Err: errReset}, err)
+}
+
+func TestExpectWithin(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("Status: FAIL\n" + strings.Repeat("log line\n", 10) + "Status: OK\nrouter#")
+
+	full, groups, err := sh.ExpectWithin(cliexpect.RegexMatcher(`Status: (\S+)`), 20)
+	assert.NoError(t, err)
+	assert.Equal(t, "Status: OK\nrouter#", full[len(full)-18:])
+	assert.Equal(t, []string{"Status: OK", "OK", "router#"}, groups)
+}
+
+func TestSetPromptDuringRetrieve(t *testing.T) {
+	r, w := io.Pipe()
+	sh := cliexpect.New(new(writer), r)
+	sh.SetPromptRegex(`\S+#`)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, groups, err := sh.Retrieve()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"test\n", "router#"}, groups)
+	}()
+	// Run with -race to verify
+	for i := 0; i < 100; i++ {
+		sh.SetPromptRegex(`\S+#`)
+		sh.SetPromptAnchor("^", "$")
+		sh.SetFullIncludesPrompt(true)
+	}
+	w.Write([]byte("test\nrouter#"))
+	<-done
+}
+
+func TestExpectSequence(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("router#\nrouter(config)#\nrouter(config-if)#\nrouter#")
+
+	matches, err := sh.ExpectSequence(`router#`, `router\(config\)#`, `router\(config-if\)#`)
+	assert.NoError(t, err)
+	assert.Len(t, matches, 3)
+	assert.Equal(t, "router(config-if)#", matches[2].Prompt)
+
+	sh.FeedForTest("\nrouter(config)#")
+	matches, err = sh.ExpectSequence(`router#`, `router#`)
+	assert.Len(t, matches, 1)
+	assert.Equal(t, &cliexpect.SequenceError{Step: 1, Expected: `router#`,
+		Err: &cliexpect.UnexpectedPromptError{Body: "\n", Prompt: "router(config)#"}}, err)
+}
+
+func TestSetPromptLiteral(t *testing.T) {
+	inputs := []string{
+		"test\nrouter#",
+		"router#\nrouter#x\nrouter#",
+		"xrouter#\nrouter# \nrouter#\nmore",
+		"router#router#\nrouter#",
+		"no prompt\n",
+		"router#",
+	}
+	for _, strict := range []bool{false, true} {
+		for _, input := range inputs {
+			param := cliexpect.ShellParam{StrictPrompt: strict, Timeout: time.Millisecond}
+			literal := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+			literal.SetPrompt("router#")
+			regex := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+			regex.SetPromptRegex(`router#`)
+			literal.FeedForTest(input)
+			regex.FeedForTest(input)
+
+			full, groups, err := literal.Retrieve()
+			expFull, expGroups, expErr := regex.Retrieve()
+			assert.Equal(t, expFull, full, "%q strict=%v", input, strict)
+			assert.Equal(t, expGroups, groups, "%q strict=%v", input, strict)
+			assert.Equal(t, expErr, err, "%q strict=%v", input, strict)
+		}
+	}
+}
+
+func benchmarkPrompt(b *testing.B, setPrompt func(sh *cliexpect.Shell)) {
+	data := strings.Repeat("some line of output from the device\n", 400) + "router#"
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	setPrompt(sh)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sh.FeedForTest(data)
+		if _, _, err := sh.Retrieve(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPromptRegex(b *testing.B) {
+	benchmarkPrompt(b, func(sh *cliexpect.Shell) { sh.SetPromptRegex(`\Qrouter#\E`) })
+}
+
+func BenchmarkPromptLiteral(b *testing.B) {
+	benchmarkPrompt(b, func(sh *cliexpect.Shell) { sh.SetPrompt("router#") })
+}
+
+func TestMaxRetrieveIterations(t *testing.T) {
+	r, w := io.Pipe()
+	param := cliexpect.ShellParam{MaxRetrieveIterations: 3}
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	sh.SetPromptRegex(`\S+#`)
+
+	go func() {
+		for {
+			if _, err := w.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	_, _, err := sh.Retrieve()
+	assert.Equal(t, cliexpect.ErrTooManyIterations, err)
+	assert.True(t, time.Since(start) < time.Second)
+	r.Close()
+}
+
+func TestTryRetrieve(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("test")
+
+	_, ok := sh.TryRetrieve()
+	assert.False(t, ok)
+
+	sh.FeedForTest("\nrouter#")
+	match, ok := sh.TryRetrieve()
+	assert.True(t, ok)
+	assert.Equal(t, cliexpect.Match{Full: "test\nrouter#", Groups: []string{"test\n", "router#"},
+		Body: "test\n", Prompt: "router#"}, match)
+
+	// Nothing was consumed
+	full, _, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, match.Full, full)
+}
+
+func TestPostMatchGrace(t *testing.T) {
+	r, w := io.Pipe()
+	param := cliexpect.ShellParam{PostMatchGrace: time.Second}
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	sh.SetPromptRegex(`\S+#`)
+
+	go func() {
+		w.Write([]byte("one\nrouter#"))
+		w.Write([]byte("\n"))
+		w.Write([]byte("two\nrouter#\n"))
+	}()
+	full, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "one\nrouter#", full)
+	assert.Equal(t, []string{"one\n", "router#"}, groups)
+
+	// The split trailing newline didn't leak into the next body
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"two\n", "router#"}, groups)
+	assert.Equal(t, 0, sh.PendingPrompts())
+	r.Close()
+}
+
+func TestExpectBodyAtPrompt(t *testing.T) {
+	r, w := io.Pipe()
+	sh := cliexpect.New(new(writer), r)
+	sh.SetPromptRegex(`\S+#`)
+
+	go func() {
+		// Looks like a prompt, but the body isn't complete there yet
+		w.Write([]byte("copying...\nfake#\n"))
+		w.Write([]byte("done: 42 bytes\nrouter#"))
+	}()
+	match, err := sh.ExpectBodyAtPrompt(cliexpect.RegexMatcher(`done: (\d+)`))
+	assert.NoError(t, err)
+	assert.Equal(t, "copying...\nfake#\ndone: 42 bytes\n", match.Body)
+	assert.Equal(t, "router#", match.Prompt)
+	assert.Equal(t, []string{"done: 42", "42", "router#"}, match.Groups)
+	assert.Equal(t, "router#", sh.LastPrompt())
+	r.Close()
+}
+
+func TestExpectEach(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("OK 1\nrouter#\nOK 2\nrouter#\nFAIL\nrouter#")
+
+	matches, err := sh.ExpectEach(3, cliexpect.RegexMatcher(`OK (\d)`))
+	assert.Len(t, matches, 2)
+	assert.Equal(t, []string{"OK 2", "2", "router#"}, matches[1].Groups)
+	assert.Equal(t, &cliexpect.EachError{Index: 2,
+		Err: &cliexpect.BodyMismatchError{Body: "\nFAIL\n", Prompt: "router#"}}, err)
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	param := cliexpect.ShellParam{AdaptiveTimeout: cliexpect.AdaptiveTimeout{Min: 20 * time.Millisecond,
+		Max: time.Second, Multiplier: 3}}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("fast\nrouter#")
+	_, _, err := sh.Retrieve()
+	assert.NoError(t, err)
+
+	// The average is tiny, so the timeout is bounded by Min instead of the 10s default
+	start := time.Now()
+	_, _, err = sh.Retrieve()
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	// An explicit timeout is still honored
+	start = time.Now()
+	assert.Error(t, sh.ExpectEmptyBody(100*time.Millisecond))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+}
+
+func TestSendExpectDelay(t *testing.T) {
+	w := &scriptedShell{responses: []string{"ready\nrouter#"}}
+	param := cliexpect.ShellParam{SendExpectDelay: 50 * time.Millisecond}
+	sh := cliexpect.NewWithParam(w, new(blockingReader), param)
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+
+	start := time.Now()
+	_, err := sh.ExpectRetry("status", cliexpect.StrMatcher("ready"), 1, 0)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// Plain sends aren't delayed
+	start = time.Now()
+	assert.NoError(t, sh.SendLine("status"))
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+}
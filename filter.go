@@ -0,0 +1,87 @@
+package cliexpect
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// Filter transforms a chunk of data received from the shell before it is buffered. It may modify and
+// return the slice passed to it or return a new one, but must not retain it after returning since the
+// reader reuses it. Each filter sees every chunk exactly as read, so a sequence split across two reads
+// (such as an escape sequence or a "\r\n") is seen in two parts - stateful filters must account for this
+type Filter func([]byte) []byte
+
+// ansiRegex matches ANSI escape sequences: CSI sequences, OSC sequences, and two byte escapes
+var ansiRegex = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[=>@-Z\\-_])`)
+
+// namedFilter is a filter in the chain along with the name it was added by, if any
+type namedFilter struct {
+	name string
+	f    Filter
+}
+
+// filterRegistry holds the filters that can be added by name
+var filterRegistry = struct {
+	sync.RWMutex
+	filters map[string]Filter
+}{filters: map[string]Filter{"ansi": StripANSI, "crlf": NormalizeCRLF}}
+
+// RegisterFilter registers a filter under name so it can be added with AddNamedFilter, replacing any
+// filter already registered under it. StripANSI ("ansi") and NormalizeCRLF ("crlf") are built in
+func RegisterFilter(name string, f Filter) {
+	filterRegistry.Lock()
+	filterRegistry.filters[name] = f
+	filterRegistry.Unlock()
+}
+
+// AddFilter adds a filter to the end of the filter chain. Filters are applied in the order they were
+// added to each chunk of data after any NULHandling, and before it is buffered. Output sinks receive
+// the data before it is filtered
+func (s *Shell) AddFilter(f Filter) {
+	s.addFilter(namedFilter{f: f})
+}
+
+// AddNamedFilter works like AddFilter with the filter registered under name (see RegisterFilter).
+// Unlike those added by AddFilter, it is included in the configuration saved by MarshalConfig
+func (s *Shell) AddNamedFilter(name string) error {
+	filterRegistry.RLock()
+	f, ok := filterRegistry.filters[name]
+	filterRegistry.RUnlock()
+	if !ok {
+		return fmt.Errorf("No filter registered as %q", name)
+	}
+	s.addFilter(namedFilter{name: name, f: f})
+	return nil
+}
+
+// addFilter adds the filter to the end of the filter chain
+func (s *Shell) addFilter(f namedFilter) {
+	s.hookLock.Lock()
+	// Copy on write so the reader can keep using its snapshot without holding the lock
+	s.param.filters = append(s.param.filters[:len(s.param.filters):len(s.param.filters)], f)
+	s.hookLock.Unlock()
+}
+
+// applyFilters runs the chunk through the filter chain
+func (s *Shell) applyFilters(b []byte) []byte {
+	s.hookLock.RLock()
+	filters := s.param.filters
+	s.hookLock.RUnlock()
+
+	for _, f := range filters {
+		b = f.f(b)
+	}
+	return b
+}
+
+// StripANSI is a filter that removes ANSI escape sequences (colors, cursor movement, etc.)
+func StripANSI(b []byte) []byte {
+	return ansiRegex.ReplaceAll(b, nil)
+}
+
+// NormalizeCRLF is a filter that converts "\r\n" line endings to "\n"
+func NormalizeCRLF(b []byte) []byte {
+	return bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+}
@@ -0,0 +1,33 @@
+package cliexpect_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripANSI(t *testing.T) {
+	data := "\x1b[1;32mgreen\x1b[0m \x1b]0;title\x07text\x1b=\x1b[K"
+	assert.Equal(t, []byte("green text"), cliexpect.StripANSI([]byte(data)))
+}
+
+func TestNormalizeCRLF(t *testing.T) {
+	assert.Equal(t, []byte("a\nb\n\r"), cliexpect.NormalizeCRLF([]byte("a\r\nb\r\n\r")))
+}
+
+func TestAddFilter(t *testing.T) {
+	r, w := io.Pipe()
+	sh := cliexpect.New(new(writer), r)
+	sh.SetPromptRegex(`\S+#`)
+	sh.AddFilter(cliexpect.StripANSI)
+	sh.AddFilter(cliexpect.NormalizeCRLF)
+	sh.AddFilter(func(b []byte) []byte { return bytes.ToUpper(b) })
+
+	go w.Write([]byte("\x1b[1mok\x1b[0m\r\nrouter#"))
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"OK\n", "ROUTER#"}, groups)
+}
@@ -0,0 +1,160 @@
+package cliexpect
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// goldenPlaceholders are the placeholders ExpectTemplate accepts along with the regex each matches
+var goldenPlaceholders = map[string]string{
+	"num":    `[-+]?\d+(?:\.\d+)?`,
+	"word":   `\S+`,
+	"ignore": `.*`,
+}
+
+// goldenPlaceholderRegex finds the placeholders in a template line
+var goldenPlaceholderRegex = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// DiffKind is the kind of difference between a template line and a body line
+type DiffKind int
+
+const (
+	// DiffMissing is a template line with no matching body line
+	DiffMissing DiffKind = iota
+	// DiffExtra is a body line not matched by any template line
+	DiffExtra
+	// DiffChanged is a template line whose body line doesn't match it
+	DiffChanged
+)
+
+// LineDiff is a single difference found by ExpectTemplate. Line numbers start at 1, and are 0 (as is
+// the corresponding text) when the kind of difference has no such line
+type LineDiff struct {
+	Kind                   DiffKind
+	TemplateLine, BodyLine int
+	Template, Body         string
+}
+
+func (d LineDiff) String() string {
+	switch d.Kind {
+	case DiffMissing:
+		return fmt.Sprintf("Template line %d missing: %q", d.TemplateLine, d.Template)
+	case DiffExtra:
+		return fmt.Sprintf("Body line %d unexpected: %q", d.BodyLine, d.Body)
+	default:
+		return fmt.Sprintf("Template line %d: expected %q, got %q (body line %d)", d.TemplateLine,
+			d.Template, d.Body, d.BodyLine)
+	}
+}
+
+// ExpectTemplate retrieves the next body, waiting up to timeout, and compares its lines (as split by
+// ExpectLines) against the lines of tmpl, returning the differences instead of a pass/fail. Template
+// text matches literally except for the placeholders {{num}} (an integer or decimal number),
+// {{word}} (a run of non-whitespace) and {{ignore}} (anything else on the line). The lines are
+// aligned by the longest common subsequence of matching lines, so one added or removed line is
+// reported on its own instead of shifting every line after it. Runs of missing and extra lines
+// between aligned ones are paired up in order as changed lines. An identical body returns no
+// differences. An error is returned before retrieving if tmpl has an unknown placeholder
+func (s *Shell) ExpectTemplate(tmpl string, timeout time.Duration) (diffs []LineDiff, err error) {
+	tmplLines := splitLines(tmpl)
+	matchers := make([]*regexp.Regexp, len(tmplLines))
+	for i, line := range tmplLines {
+		if matchers[i], err = goldenLineRegex(line); err != nil {
+			return nil, fmt.Errorf("Template line %d: %v", i+1, err)
+		}
+	}
+
+	start := time.Now()
+	_, groups, err := s.retrieve(0, timeout)
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return nil, err
+	}
+	bodyLines := splitLines(groups[0])
+	diffs = diffLines(tmplLines, bodyLines, func(i, j int) bool { return matchers[i].MatchString(bodyLines[j]) })
+	s.observeExpect(start, len(diffs) == 0)
+	return diffs, err
+}
+
+// goldenLineRegex converts a template line into a regex matching a whole body line
+func goldenLineRegex(line string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString(`\A`)
+	last := 0
+	for _, loc := range goldenPlaceholderRegex.FindAllStringSubmatchIndex(line, -1) {
+		name := line[loc[2]:loc[3]]
+		re, ok := goldenPlaceholders[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown placeholder %q", name)
+		}
+		b.WriteString(regexp.QuoteMeta(line[last:loc[0]]))
+		b.WriteString(re)
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(line[last:]))
+	b.WriteString(`\z`)
+	return regexp.Compile(b.String())
+}
+
+// diffLines aligns the template lines with the body lines and returns the differences. Template
+// line i matches body line j if match(i, j) returns true
+func diffLines(tmplLines, bodyLines []string, match func(i, j int) bool) []LineDiff {
+	n, m := len(tmplLines), len(bodyLines)
+	// lcs[i][j] is the length of the longest common subsequence of tmplLines[i:] and bodyLines[j:]
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	matched := make([][]bool, n)
+	for i := n - 1; i >= 0; i-- {
+		matched[i] = make([]bool, m)
+		for j := m - 1; j >= 0; j-- {
+			if matched[i][j] = match(i, j); matched[i][j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diffs []LineDiff
+	var missing, extra []int
+	flush := func() {
+		paired := len(missing)
+		if len(extra) < paired {
+			paired = len(extra)
+		}
+		for k := 0; k < paired; k++ {
+			i, j := missing[k], extra[k]
+			diffs = append(diffs, LineDiff{Kind: DiffChanged, TemplateLine: i + 1, BodyLine: j + 1,
+				Template: tmplLines[i], Body: bodyLines[j]})
+		}
+		for _, i := range missing[paired:] {
+			diffs = append(diffs, LineDiff{Kind: DiffMissing, TemplateLine: i + 1, Template: tmplLines[i]})
+		}
+		for _, j := range extra[paired:] {
+			diffs = append(diffs, LineDiff{Kind: DiffExtra, BodyLine: j + 1, Body: bodyLines[j]})
+		}
+		missing, extra = missing[:0], extra[:0]
+	}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && matched[i][j] && lcs[i][j] == lcs[i+1][j+1]+1:
+			flush()
+			i, j = i+1, j+1
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			missing = append(missing, i)
+			i++
+		default:
+			extra = append(extra, j)
+			j++
+		}
+	}
+	flush()
+	return diffs
+}
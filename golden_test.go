@@ -0,0 +1,42 @@
+package cliexpect_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+const versionTemplate = `
+Version {{num}} (build {{word}})
+Uptime: {{ignore}}
+Interfaces: 4
+Serial: ABC-{{num}}
+`
+
+func TestExpectTemplate(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+
+	sh.FeedForTest("\nVersion 1.2 (build abc7)\r\nUptime: 3 days, 2 hours\r\nInterfaces: 4\r\nSerial: ABC-42\r\nrouter#")
+	diffs, err := sh.ExpectTemplate(versionTemplate, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	// An added line doesn't misalign the lines after it
+	sh.FeedForTest("\nVersion 1.2 (build abc7)\nWARNING: license expired\nUptime: 3 days\nInterfaces: 5\nrouter#")
+	diffs, err = sh.ExpectTemplate(versionTemplate, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, []cliexpect.LineDiff{
+		{Kind: cliexpect.DiffExtra, BodyLine: 2, Body: "WARNING: license expired"},
+		{Kind: cliexpect.DiffChanged, TemplateLine: 3, BodyLine: 4, Template: "Interfaces: 4", Body: "Interfaces: 5"},
+		{Kind: cliexpect.DiffMissing, TemplateLine: 4, Template: "Serial: ABC-{{num}}"},
+	}, diffs)
+	assert.Equal(t, `Template line 3: expected "Interfaces: 4", got "Interfaces: 5" (body line 4)`, diffs[1].String())
+
+	_, err = sh.ExpectTemplate("Version {{bogus}}", time.Millisecond)
+	assert.Error(t, err)
+	_, err = sh.ExpectTemplate(versionTemplate, time.Millisecond)
+	assert.Error(t, err)
+}
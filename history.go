@@ -0,0 +1,43 @@
+package cliexpect
+
+import "time"
+
+// Operation is a record of a single send or retrieve kept for History. A send only has Sent set, and
+// a retrieve (by Retrieve, Expect or any other operation that retrieves up to a prompt) only has Body
+// and Prompt set. Err and Duration are set for both
+type Operation struct {
+	Time     time.Time
+	Sent     string
+	Body     string
+	Prompt   string
+	Err      error
+	Duration time.Duration
+}
+
+// History returns up to the last HistorySize operations, oldest first. It is always empty if
+// HistorySize is zero
+func (s *Shell) History() []Operation {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Once the ring is full, the oldest operation is the next one to be overwritten
+	ops := make([]Operation, 0, len(s.history))
+	ops = append(ops, s.history[s.historyNext:]...)
+	return append(ops, s.history[:s.historyNext]...)
+}
+
+// record adds the operation to the history ring, overwriting the oldest once it is full. The caller
+// must hold the lock
+func (s *Shell) record(op Operation) {
+	size := s.param.HistorySize
+	if size < 1 {
+		return
+	}
+	op.Duration = time.Since(op.Time)
+	if len(s.history) < size {
+		s.history = append(s.history, op)
+		return
+	}
+	s.history[s.historyNext] = op
+	s.historyNext = (s.historyNext + 1) % size
+}
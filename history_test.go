@@ -0,0 +1,40 @@
+package cliexpect_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	w := &scriptedShell{responses: []string{"one\nrouter#", "two\nrouter#"}}
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond, HistorySize: 3}
+	sh := cliexpect.NewWithParam(w, new(blockingReader), param)
+	w.sh = sh
+	sh.SetPromptRegex(`\S+#`)
+
+	for _, cmd := range []string{"show one", "show two"} {
+		assert.NoError(t, sh.SendLine(cmd))
+		_, _, err := sh.Retrieve()
+		assert.NoError(t, err)
+	}
+	_, _, err := sh.Retrieve()
+	assert.Error(t, err)
+
+	// The first send and retrieve have been overwritten
+	history := sh.History()
+	assert.Len(t, history, 3)
+	assert.Equal(t, "show two\n", history[0].Sent)
+	assert.NoError(t, history[0].Err)
+	assert.Equal(t, "two\n", history[1].Body)
+	assert.Equal(t, "router#", history[1].Prompt)
+	assert.Equal(t, err, history[2].Err)
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	assert.NoError(t, sh.SendLine("show one"))
+	assert.Empty(t, sh.History())
+}
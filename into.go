@@ -0,0 +1,125 @@
+package cliexpect
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// intoTag is the struct tag naming the capture group assigned to a field by ExpectInto
+const intoTag = "cliexpect"
+
+// ExpectInto retrieves the next body, matches re against it, and assigns each named capture group to
+// the field of the struct pointed to by dest with a matching `cliexpect:"name"` tag, or, if untagged,
+// the same name ignoring case. Fields may be strings, bools, or any int, uint or float type. An error
+// is returned before retrieving if a named group has no field, and after if a value can't be
+// converted to its field type. A group that doesn't participate in the match leaves its field
+// unchanged. Like RegexMatcher, it panics if re is invalid
+func (s *Shell) ExpectInto(re string, dest interface{}) error {
+	r := regexp.MustCompile(matchFmt + re)
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Destination must be a non-nil pointer to a struct, not %T", dest)
+	}
+	v = v.Elem()
+	fields, err := intoFields(r, v.Type())
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	_, groups, err := s.retrieve(0, s.timeout())
+	if len(groups) < 2 {
+		s.observeExpect(start, false)
+		return err
+	}
+	result := r.FindStringSubmatchIndex(groups[0])
+	s.observeExpect(start, result != nil)
+	if result == nil {
+		if err == nil || err == io.EOF {
+			err = ErrNoMatches
+		}
+		return err
+	}
+	names := r.SubexpNames()
+	for group, field := range fields {
+		begin, end := result[group*2], result[group*2+1]
+		if begin < 0 {
+			continue
+		}
+		if convErr := setField(v.Field(field), groups[0][begin:end]); convErr != nil {
+			return fmt.Errorf("Group %q: %v", names[group], convErr)
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// intoFields maps the index of each named group in r to the index of its field in t
+func intoFields(r *regexp.Regexp, t reflect.Type) (map[int]int, error) {
+	fields := make(map[int]int)
+	for group, name := range r.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		found := false
+		for i := 0; i < t.NumField() && !found; i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" { // Unexported
+				continue
+			}
+			tag, tagged := f.Tag.Lookup(intoTag)
+			if (tagged && tag == name) || (!tagged && strings.EqualFold(f.Name, name)) {
+				fields[group], found = i, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No field for group %q in %s", name, t)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Regex %q has no named groups", r.String())
+	}
+	return fields, nil
+}
+
+// setField converts text to the type of the field and assigns it
+func setField(field reflect.Value, text string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(text, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(text, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(text, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("Unsupported field type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package cliexpect_test
+
+import (
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+type iface struct {
+	Name    string
+	Up      bool `cliexpect:"status"`
+	MTU     uint16
+	Load    float64
+	Errors  int
+	ignored string
+}
+
+func TestExpectInto(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("Gi0/1 up=true mtu 1500 load 0.25\nrouter#")
+
+	dest := iface{Errors: 7}
+	err := sh.ExpectInto(`(?P<name>\S+) up=(?P<status>\w+) mtu (?P<mtu>\d+) load (?P<load>\S+)(?: errors (?P<errors>\d+))?`, &dest)
+	assert.NoError(t, err)
+	// Errors didn't participate in the match so it is unchanged
+	assert.Equal(t, iface{Name: "Gi0/1", Up: true, MTU: 1500, Load: 0.25, Errors: 7}, dest)
+}
+
+func TestExpectIntoErrors(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+	var dest iface
+
+	assert.Error(t, sh.ExpectInto(`(?P<name>\S+)`, dest))
+	assert.Error(t, sh.ExpectInto(`(\S+)`, &dest))
+	assert.Error(t, sh.ExpectInto(`(?P<speed>\S+)`, &dest))
+	assert.Error(t, sh.ExpectInto(`(?P<ignored>\S+)`, &dest))
+
+	sh.FeedForTest("mtu 99999\nrouter#")
+	assert.Error(t, sh.ExpectInto(`mtu (?P<mtu>\d+)`, &dest))
+	sh.FeedForTest("nothing\nrouter#")
+	assert.Equal(t, cliexpect.ErrNoMatches, sh.ExpectInto(`mtu (?P<mtu>\d+)`, &dest))
+}
@@ -0,0 +1,62 @@
+package cliexpect
+
+// Macro is a reusable interaction with a shell, typically composed from the step constructors below
+type Macro func(*Shell) error
+
+// Run runs the macro against this shell
+func (s *Shell) Run(m Macro) error {
+	return m(s)
+}
+
+// Steps combines macros into one that runs them in order, stopping at the first error
+func Steps(macros ...Macro) Macro {
+	return func(s *Shell) error {
+		for _, m := range macros {
+			if err := m(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// SendLineStep is a macro step that sends a line
+func SendLineStep(line string) Macro {
+	return func(s *Shell) error {
+		return s.SendLine(line)
+	}
+}
+
+// WaitForStep is a macro step that waits for a match of the regex anywhere in the received data (such
+// as a "Username:" prompt which isn't the shell prompt) and consumes everything through it
+func WaitForStep(re string) Macro {
+	return func(s *Shell) error {
+		return s.waitFor(re)
+	}
+}
+
+// ExpectStep is a macro step that calls Expect with the matcher, failing if it doesn't match
+func ExpectStep(m Matcher) Macro {
+	return func(s *Shell) error {
+		if _, groups, err := s.Expect(m); groups == nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// RetrieveStep is a macro step that retrieves through the next shell prompt, discarding the results
+func RetrieveStep() Macro {
+	return func(s *Shell) error {
+		if _, groups, err := s.Retrieve(); groups == nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// Login is a macro that waits for the username prompt, sends the user, waits for the password prompt,
+// sends the password, and then retrieves through the shell prompt
+func Login(userRe, user, passRe, pass string) Macro {
+	return Steps(WaitForStep(userRe), SendLineStep(user), WaitForStep(passRe), SendLineStep(pass), RetrieveStep())
+}
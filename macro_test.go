@@ -0,0 +1,32 @@
+package cliexpect_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogin(t *testing.T) {
+	w := new(strings.Builder)
+	sh := cliexpect.New(w, &blockingReader{data: "Username: Password: \nWelcome\nrouter#"})
+	sh.SetPromptRegex(`\S+#`)
+
+	assert.NoError(t, sh.Run(cliexpect.Login("Username: ", "admin", "Password: ", "secret")))
+	assert.Equal(t, "admin\nsecret\n", w.String())
+	assert.Equal(t, "router#", sh.LastPrompt())
+}
+
+func TestStepsStopOnError(t *testing.T) {
+	w := new(strings.Builder)
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(w, &blockingReader{data: "out\nrouter#"}, param)
+	sh.SetPromptRegex(`\S+#`)
+
+	macro := cliexpect.Steps(cliexpect.SendLineStep("show"), cliexpect.ExpectStep(cliexpect.StrMatcher("missing")),
+		cliexpect.SendLineStep("never"))
+	assert.Equal(t, &cliexpect.BodyMismatchError{Body: "out\n", Prompt: "router#"}, sh.Run(macro))
+	assert.Equal(t, "show\n", w.String())
+}
@@ -1,8 +1,11 @@
 package cliexpect
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
+	"strings"
+	"unicode/utf8"
 )
 
 // Matcher is a function for matching data in expect operations. The returned slice matches the
@@ -23,3 +26,239 @@ func RegexMatcher(regex string) Matcher {
 func StrMatcher(str string) Matcher {
 	return RegexMatcher(fmt.Sprintf(`\Q%s\E`, str))
 }
+
+// GlobMatcher matches a shell style glob pattern in expect operations. A "*" matches any run of
+// characters and "?" any single character, but neither matches a newline. A "[...]" matches any one
+// listed character or range, or any other character if it starts with "!" or "^". A "]" first in the
+// class is literal, and a "[" that is never closed is literal. Everything else matches literally
+func GlobMatcher(pattern string) Matcher {
+	return RegexMatcher(globToRegex(pattern))
+}
+
+// globToRegex translates a glob pattern into an equivalent regex
+func globToRegex(glob string) string {
+	var b strings.Builder
+	lit := 0
+	for i := 0; i < len(glob); i++ {
+		var re string
+		end := i
+		switch glob[i] {
+		case '*':
+			re = `[^\n]*`
+		case '?':
+			re = `[^\n]`
+		case '[':
+			if end = globClassEnd(glob, i); end < 0 {
+				continue // Unclosed, so it stays part of the literal
+			}
+			re = globClass(glob[i+1 : end])
+		default:
+			continue
+		}
+		// All the special characters are ASCII, so the literal can be sliced out by byte
+		b.WriteString(regexp.QuoteMeta(glob[lit:i]))
+		b.WriteString(re)
+		i = end
+		lit = end + 1
+	}
+	b.WriteString(regexp.QuoteMeta(glob[lit:]))
+	return b.String()
+}
+
+// globClassEnd returns the index of the "]" closing the class that starts at begin, or -1 if none
+func globClassEnd(glob string, begin int) int {
+	i := begin + 1
+	if i < len(glob) && (glob[i] == '!' || glob[i] == '^') {
+		i++
+	}
+	if i < len(glob) && glob[i] == ']' {
+		i++
+	}
+	if end := strings.IndexByte(glob[i:], ']'); end >= 0 {
+		return i + end
+	}
+	return -1
+}
+
+// globClass translates the contents of a glob character class into a regex character class
+func globClass(class string) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	if class[0] == '!' || class[0] == '^' {
+		b.WriteString(`^\n`)
+		class = class[1:]
+	}
+	for i := 0; i < len(class); i++ {
+		switch class[i] {
+		case '\\', '[', ']', '^':
+			b.WriteByte('\\')
+			fallthrough
+		default:
+			b.WriteByte(class[i])
+		}
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// errorPatterns are the regexes for ErrorPatterns
+var errorPatterns = []string{
+	`^% .*?$`, // Cisco style: "% Invalid input detected at '^' marker."
+	`^\s*(?:Error|ERROR|error):.*?$`,
+	`^.*?: command not found$`,
+	`^.*?(?:Invalid input|Unknown command|Syntax error|Incomplete command).*?$`,
+}
+
+// ErrorPatterns returns a new slice of matchers for common device and shell error messages. Each
+// matches the entire line of the error
+func ErrorPatterns() []Matcher {
+	matchers := make([]Matcher, len(errorPatterns))
+	for i, pattern := range errorPatterns {
+		matchers[i] = RegexMatcher(pattern)
+	}
+	return matchers
+}
+
+// errorMatchers are the ErrorPatterns compiled once for ExpectOrError
+var errorMatchers = ErrorPatterns()
+
+// AnyMatcher combines matchers returning the result of the first one (in argument order) that matches
+func AnyMatcher(matchers ...Matcher) Matcher {
+	return func(input string) []int {
+		for _, m := range matchers {
+			if result := m(input); len(result) >= 2 {
+				return result
+			}
+		}
+		return nil
+	}
+}
+
+// CompleteLineMatcher matches a regex in expect operations like RegexMatcher, but only where the
+// match ends at a line ending (either just before or just after a newline). This prevents matching a
+// fragment of a line that is still arriving (ex: `.*error.*` matching before the rest of the line
+// is read, truncating the capture)
+func CompleteLineMatcher(regex string) Matcher {
+	re := regexp.MustCompile(matchFmt + regex)
+
+	return func(input string) []int {
+		for _, result := range re.FindAllStringSubmatchIndex(input, -1) {
+			if end := result[1]; (end > 0 && input[end-1] == '\n') || (end < len(input) && input[end] == '\n') {
+				return result
+			}
+		}
+		return nil
+	}
+}
+
+// TailMatcher scopes m to only the last n bytes of the input (moved forward to the start of a UTF-8
+// character if needed), with the results still indexing the whole input. This avoids false matches
+// on earlier occurrences in long output. If the input is no longer than n, m sees all of it
+func TailMatcher(n int, m Matcher) Matcher {
+	return func(input string) []int {
+		offset := 0
+		if len(input) > n {
+			offset = len(input) - n
+			for offset < len(input) && !utf8.RuneStart(input[offset]) {
+				offset++
+			}
+		}
+		result := m(input[offset:])
+		for i := range result {
+			if result[i] >= 0 {
+				result[i] += offset
+			}
+		}
+		return result
+	}
+}
+
+// ExactMatcher matches the entire input only if it is exactly equal to str
+func ExactMatcher(str string) Matcher {
+	return func(input string) []int {
+		if input == str {
+			return []int{0, len(input)}
+		}
+		return nil
+	}
+}
+
+// ExactTrimMatcher matches the entire input only if it is equal to str once leading and trailing
+// whitespace is trimmed from both
+func ExactTrimMatcher(str string) Matcher {
+	str = strings.TrimSpace(str)
+
+	return func(input string) []int {
+		if strings.TrimSpace(input) == str {
+			return []int{0, len(input)}
+		}
+		return nil
+	}
+}
+
+// JSONMatcher matches the first complete top-level JSON object or array in the input along with
+// any nested values, skipping over brackets inside quoted strings (including escaped quotes). If
+// the first value found is still incomplete, nothing is matched. Brackets that are not balanced or
+// enclose something other than valid JSON (like a "[INFO]" log prefix or a "[y/n]" prompt before the
+// JSON) are skipped
+func JSONMatcher() Matcher {
+	return func(input string) []int {
+		for start := 0; start < len(input); {
+			idx := strings.IndexAny(input[start:], "{[")
+			if idx < 0 {
+				return nil
+			}
+			begin := start + idx
+			end, complete := scanJSON(input, begin)
+			if complete && json.Valid([]byte(input[begin:end])) {
+				return []int{begin, end}
+			}
+			if end < 0 { // Incomplete - maybe more data is on the way
+				return nil
+			}
+			start = begin + 1
+		}
+		return nil
+	}
+}
+
+// scanJSON scans a JSON value starting at the opening bracket at begin. It returns the index just
+// past the closing bracket and true if complete, the index of an unbalanced bracket and false if
+// the brackets don't match, or -1 and false if the input ends before the value is complete
+func scanJSON(input string, begin int) (int, bool) {
+	var closers []byte
+	inString, escaped := false, false
+
+	for i := begin; i < len(input); i++ {
+		c := input[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			closers = append(closers, '}')
+		case '[':
+			closers = append(closers, ']')
+		case '}', ']':
+			if closers[len(closers)-1] != c {
+				return i, false
+			}
+			closers = closers[:len(closers)-1]
+			if len(closers) == 0 {
+				return i + 1, true
+			}
+		}
+	}
+	return -1, false
+}
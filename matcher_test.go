@@ -20,3 +20,114 @@ func TestStrMatcher(t *testing.T) {
 	result := m(data)
 	assert.Equal(t, []int{0, 10}, result)
 }
+
+func TestGlobMatcher(t *testing.T) {
+	tests := []struct {
+		name, glob, data string
+		result           []int
+	}{
+		{"Star", "router*#", "x\nrouter-01#", []int{2, 12}},
+		{"StarNoNewline", "router*#", "router\n#", nil},
+		{"Question", "r?#", "ra#", []int{0, 3}},
+		{"Class", "eth[0-2]", "eth3 eth1", []int{5, 9}},
+		{"NegatedClass", "eth[!0-2]", "eth1 eth3", []int{5, 9}},
+		{"BracketFirst", "[]a]", "x]", []int{1, 2}},
+		{"Unclosed", "a[b", "a[b", []int{0, 3}},
+		{"Metachars", "a.b(c)+$", "axb(c)+$ a.b(c)+$", []int{9, 17}},
+		{"Backslash", `a\b`, `a\b`, []int{0, 3}},
+		{"Unicode", "café *", "café ok", []int{0, 8}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.result, cliexpect.GlobMatcher(test.glob)(test.data))
+		})
+	}
+}
+
+func TestErrorPatterns(t *testing.T) {
+	m := cliexpect.AnyMatcher(cliexpect.ErrorPatterns()...)
+
+	tests := []struct {
+		name, data string
+		result     []int
+	}{
+		{"Percent", "show foo\n% Invalid input detected\n", []int{9, 33}},
+		{"Error", "Error: no such file\n", []int{0, 19}},
+		{"NotFound", "bash: foo: command not found\n", []int{0, 28}},
+		{"Unknown", "Unknown command 'foo'", []int{0, 21}},
+		{"NoError", "All good\n", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.result, m(test.data))
+		})
+	}
+}
+
+func TestAnyMatcher(t *testing.T) {
+	m := cliexpect.AnyMatcher(cliexpect.StrMatcher("two"), cliexpect.StrMatcher("one"))
+	assert.Equal(t, []int{4, 7}, m("one two"))
+	assert.Nil(t, m("three"))
+}
+
+func TestCompleteLineMatcher(t *testing.T) {
+	m := cliexpect.CompleteLineMatcher(`^\S* error ([\w ]+)`)
+	data := "ok\nsome error happened here\n"
+	// Fed one byte at a time, nothing matches until the line is complete
+	for i := 0; i < len(data); i++ {
+		assert.Nil(t, m(data[:i]), "%q", data[:i])
+	}
+	assert.Equal(t, []int{3, 27, 14, 27}, m(data))
+	// A match ending mid-line never matches
+	assert.Nil(t, cliexpect.CompleteLineMatcher(`error \w+`)(data))
+	assert.Equal(t, []int{3, 28}, cliexpect.CompleteLineMatcher(`^[^\n]*error[^\n]*\n`)(data))
+}
+
+func TestTailMatcher(t *testing.T) {
+	m := cliexpect.TailMatcher(8, cliexpect.RegexMatcher(`(OK)`))
+	assert.Equal(t, []int{11, 13, 11, 13}, m("OK\nworking\nOK\ndone"))
+	assert.Nil(t, m("OK\nworking\ndone"))
+	// Shorter than n matches the whole input
+	assert.Equal(t, []int{0, 2, 0, 2}, m("OK"))
+	// Never starts in the middle of a character
+	assert.Equal(t, []int{2, 3}, cliexpect.TailMatcher(3, cliexpect.RegexMatcher(`.`))("é.x"))
+}
+
+func TestExactMatcher(t *testing.T) {
+	m := cliexpect.ExactMatcher("OK")
+	assert.Equal(t, []int{0, 2}, m("OK"))
+	assert.Nil(t, m("\nOK\n"))
+	assert.Nil(t, m("NOT OK"))
+}
+
+func TestExactTrimMatcher(t *testing.T) {
+	m := cliexpect.ExactTrimMatcher("OK\n")
+	assert.Equal(t, []int{0, 4}, m("\nOK\n"))
+	assert.Nil(t, m("NOT OK"))
+}
+
+func TestJSONMatcher(t *testing.T) {
+	m := cliexpect.JSONMatcher()
+
+	tests := []struct {
+		name, data string
+		result     []int
+	}{
+		{"Object", `{"a": 1}`, []int{0, 8}},
+		{"Array", `x [1, [2, 3]] y`, []int{2, 13}},
+		{"Nested", `{"a": {"b": [1, {}]}}`, []int{0, 21}},
+		{"BracesInString", `{"a": "}{]["}`, []int{0, 13}},
+		{"EscapedQuote", `{"a": "\"}"} trailing`, []int{0, 12}},
+		{"Incomplete", `{"a": {"b": 1}`, nil},
+		{"Unbalanced", `oops {] {"ok": true}`, []int{8, 20}},
+		{"LogPrefix", `[INFO] {"a": 1}`, []int{7, 15}},
+		{"Prompt", `Continue? [y/n] ["a"]`, []int{16, 21}},
+		{"InsideInvalid", `[see {"a": 1}]`, []int{5, 13}},
+		{"None", "no json here", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.result, m(test.data))
+		})
+	}
+}
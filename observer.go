@@ -0,0 +1,66 @@
+package cliexpect
+
+import "time"
+
+// Observer receives instrumentation events from a Shell, typically to feed a metrics system such
+// as Prometheus without cliexpect depending on it. Methods may be called from the reader goroutine
+// and must be safe for concurrent use
+type Observer interface {
+	// OnExpect is called after every expect operation (Retrieve, Expect and friends) with the time it
+	// took and whether or not it matched
+	OnExpect(d time.Duration, matched bool)
+	// OnBytes is called each time data is sent to or received from the shell with the byte counts
+	OnBytes(sent, received int)
+}
+
+// SlowMatchObserver is optionally implemented by an Observer to be told when a single match attempt
+// takes at least SlowMatchThreshold, such as a complex matcher run against a very large buffer on
+// every read. inputLen is the length of the data matched
+type SlowMatchObserver interface {
+	OnSlowMatch(d time.Duration, inputLen int)
+}
+
+// SetObserver registers an observer to receive instrumentation events, replacing any prior one. A
+// nil observer disables instrumentation
+func (s *Shell) SetObserver(o Observer) {
+	s.hookLock.Lock()
+	s.param.observer = o
+	s.hookLock.Unlock()
+}
+
+// observer returns the currently registered observer, if any
+func (s *Shell) observer() Observer {
+	s.hookLock.RLock()
+	defer s.hookLock.RUnlock()
+	return s.param.observer
+}
+
+// observeExpect reports an expect operation that began at start to the observer
+func (s *Shell) observeExpect(start time.Time, matched bool) {
+	if o := s.observer(); o != nil {
+		o.OnExpect(time.Since(start), matched)
+	}
+}
+
+// observeBytes reports bytes sent and received to the observer
+func (s *Shell) observeBytes(sent, received int) {
+	if o := s.observer(); o != nil {
+		o.OnBytes(sent, received)
+	}
+}
+
+// match runs m against data, reporting the attempt to the observer if it is slow
+func (s *Shell) match(m Matcher, data string) []int {
+	threshold := s.param.SlowMatchThreshold
+	if threshold <= 0 {
+		return m(data)
+	}
+	start := time.Now()
+	result := m(data)
+	if d := time.Since(start); d >= threshold {
+		if o, ok := s.observer().(SlowMatchObserver); ok {
+			o.OnSlowMatch(d, len(data))
+		}
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+package cliexpect_test
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+type observer struct {
+	lock             sync.Mutex
+	expects, matched int
+	sent, received   int
+}
+
+func (o *observer) OnExpect(d time.Duration, matched bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.expects++
+	if matched {
+		o.matched++
+	}
+}
+
+func (o *observer) OnBytes(sent, received int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.sent += sent
+	o.received += received
+}
+
+func TestObserver(t *testing.T) {
+	data := "test\nrouter#"
+	r, w := io.Pipe()
+	param := cliexpect.ShellParam{Timeout: 100 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), r, param)
+	sh.SetPromptRegex(`\S+#`)
+	o := new(observer)
+	sh.SetObserver(o)
+
+	assert.NoError(t, sh.SendLine("bogus"))
+	go w.Write([]byte(data))
+	_, _, err := sh.ExpectRegex("test.+")
+	assert.NoError(t, err)
+	_, _, err = sh.ExpectRegex("test.+")
+	assert.Error(t, err)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	assert.Equal(t, 2, o.expects)
+	assert.Equal(t, 1, o.matched)
+	assert.Equal(t, 6, o.sent)
+	assert.Equal(t, len(data), o.received)
+}
+
+type slowObserver struct {
+	observer
+	slow []int
+}
+
+func (o *slowObserver) OnSlowMatch(d time.Duration, inputLen int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.slow = append(o.slow, inputLen)
+}
+
+func TestSlowMatchObserver(t *testing.T) {
+	param := cliexpect.ShellParam{SlowMatchThreshold: time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), new(blockingReader), param)
+	o := new(slowObserver)
+	sh.SetObserver(o)
+	sh.SetPromptRegex(`\S+#`)
+	sh.FeedForTest("test\nrouter#")
+
+	// The fast prompt match isn't reported, but the slow one is
+	_, _, err := sh.Retrieve()
+	assert.NoError(t, err)
+	sh.FeedForTest("data")
+	_, err = sh.ReadUntil("a", time.Second)
+	assert.NoError(t, err)
+	sh.FeedForTest("more")
+	_, _, err = sh.ExpectSkipped(func(input string) []int {
+		time.Sleep(5 * time.Millisecond)
+		return []int{0, len(input)}
+	}, time.Second)
+	assert.NoError(t, err)
+	o.lock.Lock()
+	assert.Equal(t, []int{len("tamore")}, o.slow)
+	o.lock.Unlock()
+}
@@ -0,0 +1,102 @@
+package cliexpect
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// RetryError is returned by RetryOnDisconnect when the operation still fails after reconnecting, or
+// a reconnect fails. Attempts is the number of times the operation was run
+type RetryError struct {
+	Attempts int
+	Err      error // Error from the last attempt or the failed reconnect
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("Failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// Reattach replaces the transport of the shell with in and out (ex: after reconnecting to a device
+// that dropped the connection), keeping all of its configuration (prompt, parameters, hooks, etc.).
+// The old transport is closed if it is an io.Closer, ignoring any error since it has usually already
+// failed. Everything buffered from it is discarded, and all reader state is reset as if the shell
+// were new, except a Pause stays in effect. It waits for the reader of the old transport to end, so
+// unless CoalesceWindow is set, its Reader must be an io.Closer or have already failed. Background
+// tasks, the stderr reader and a Fail are not affected. It must not be called during another
+// operation or after Close
+func (s *Shell) Reattach(in io.Writer, out io.Reader) error {
+	if err := s.Failed(); err != nil {
+		return err
+	}
+	s.gateLock.Lock()
+	stopped := s.stopped
+	s.detached = !stopped
+	s.gateLock.Unlock()
+	if stopped {
+		return errors.New("Shell closed")
+	}
+
+	// Wake the reader if it is paused or over HighWater, and stop any coalescing read goroutine
+	s.gate.Broadcast()
+	close(s.coalesce.stop)
+	s.closeTransport()
+	for running := true; running; {
+		select {
+		case <-s.done:
+			running = false
+		case <-s.ch: // Unblock the reader if it's waiting to report its last read
+		}
+	}
+
+	s.lock.Lock()
+	s.in, s.out = in, out
+	s.resetBuff()
+	s.eof, s.prompted, s.lastPrompt, s.keepalives = false, false, "", 0
+	s.unwrap, s.coalesce, s.decode = unwrapper{}, coalescer{stop: make(chan struct{})}, textDecoder{}
+	s.syncErr = nil
+	for drained := false; !drained; {
+		// Notifications of reads from the old transport
+		select {
+		case <-s.ch:
+		default:
+			drained = true
+		}
+	}
+	s.updateWater()
+	s.gateLock.Lock()
+	s.detached = false
+	s.gateLock.Unlock()
+	if !s.param.SynchronousRead {
+		s.done = make(chan struct{})
+		go s.reader()
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+// RetryOnDisconnect runs op, and each time it fails with a DisconnectedError, calls reconnect for a
+// new transport, reattaches the shell to it (see Reattach) and runs op again, up to attempts more
+// times. Since op starts over on a fresh session each time, it should be safe to repeat (ex: log in,
+// then run the commands). A nil error is returned once op succeeds, and any error other than a
+// DisconnectedError is returned as is. Otherwise, a RetryError with the number of times op was run
+// is returned once the attempts run out or reconnecting fails
+func (s *Shell) RetryOnDisconnect(reconnect func() (io.Writer, io.Reader, error), op func(*Shell) error, attempts int) error {
+	for runs := 1; ; runs++ {
+		err := op(s)
+		if _, ok := err.(*DisconnectedError); !ok {
+			return err
+		}
+		if runs > attempts {
+			return &RetryError{Attempts: runs, Err: err}
+		}
+
+		in, out, err := reconnect()
+		if err == nil {
+			err = s.Reattach(in, out)
+		}
+		if err != nil {
+			return &RetryError{Attempts: runs, Err: fmt.Errorf("Reconnect failed: %v", err)}
+		}
+	}
+}
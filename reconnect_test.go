@@ -0,0 +1,84 @@
+package cliexpect_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryOnDisconnect(t *testing.T) {
+	sh := cliexpect.New(new(writer), &resetReader{data: "\nrouter#\npartial"})
+	sh.SetPromptRegex(`\S+#`)
+
+	// Each reconnect gets further until the last one delivers a whole response
+	transports := []string{"\nrouter#\npar", "\nrouter#\nok\nrouter#"}
+	reconnects := 0
+	reconnect := func() (io.Writer, io.Reader, error) {
+		reader := &resetReader{data: transports[reconnects]}
+		reconnects++
+		return new(writer), reader, nil
+	}
+	var bodies []string
+	op := func(sh *cliexpect.Shell) error {
+		// The reset may arrive along with a prompt, which is still retrieved
+		if _, groups, err := sh.Retrieve(); groups == nil {
+			return err
+		}
+		_, groups, err := sh.Retrieve()
+		if groups == nil {
+			return err
+		}
+		bodies = append(bodies, groups[0])
+		return nil
+	}
+
+	assert.NoError(t, sh.RetryOnDisconnect(reconnect, op, 2))
+	assert.Equal(t, 2, reconnects)
+	assert.Equal(t, []string{"\nok\n"}, bodies)
+	// The prompt survived the reattaches
+	assert.Equal(t, "router#", sh.LastPrompt())
+
+	// Out of attempts
+	assert.NoError(t, sh.Reattach(new(writer), &resetReader{data: "\nrouter#\npartial"}))
+	transports, reconnects = []string{"\nrouter#\n"}, 0
+	err := sh.RetryOnDisconnect(reconnect, op, 1)
+	assert.Equal(t, 1, reconnects)
+	if assert.IsType(t, &cliexpect.RetryError{}, err) {
+		assert.Equal(t, 2, err.(*cliexpect.RetryError).Attempts)
+		assert.IsType(t, &cliexpect.DisconnectedError{}, err.(*cliexpect.RetryError).Err)
+	}
+
+	// Other errors aren't retried
+	errOther := errors.New("other")
+	assert.Equal(t, errOther, sh.RetryOnDisconnect(reconnect, func(*cliexpect.Shell) error { return errOther }, 3))
+}
+
+func TestReattachWhilePaused(t *testing.T) {
+	for _, param := range []cliexpect.ShellParam{{}, {CoalesceWindow: time.Millisecond}} {
+		r, w := io.Pipe()
+		sh := cliexpect.NewWithParam(new(writer), r, param)
+		sh.SetPromptRegex(`\S+#`)
+		sh.Pause()
+
+		// The old reader is parked by the pause, but Reattach must not wait on it forever
+		done := make(chan error)
+		go func() { done <- sh.Reattach(new(writer), &blockingReader{data: "\nok\nrouter#"}) }()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Reattach hung while paused")
+		}
+		_, err := w.Write([]byte("old"))
+		assert.Equal(t, io.ErrClosedPipe, err)
+
+		sh.Resume()
+		_, groups, err := sh.Retrieve()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"\nok\n", "router#"}, groups)
+	}
+}
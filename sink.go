@@ -0,0 +1,53 @@
+package cliexpect
+
+import "io"
+
+// AddOutputSink adds a writer that receives a copy of every chunk of data received from the shell as
+// it is read. Sinks are written in the order they were added from the reader goroutine, so a slow
+// sink slows the reader. An error from one sink is ignored and doesn't stop the others being written
+func (s *Shell) AddOutputSink(w io.Writer) {
+	s.hookLock.Lock()
+	// Copy on write so the reader can keep using its snapshot without holding the lock
+	s.param.sinks = append(s.param.sinks[:len(s.param.sinks):len(s.param.sinks)], w)
+	s.hookLock.Unlock()
+}
+
+// RemoveOutputSink removes a writer previously added with AddOutputSink
+func (s *Shell) RemoveOutputSink(w io.Writer) {
+	s.hookLock.Lock()
+	defer s.hookLock.Unlock()
+
+	sinks := make([]io.Writer, 0, len(s.param.sinks))
+	for _, sink := range s.param.sinks {
+		if !sameValue(sink, w) {
+			sinks = append(sinks, sink)
+		}
+	}
+	s.param.sinks = sinks
+}
+
+// SetMirror sets a writer (typically a terminal) that mirrors the output of the shell in real time, so
+// a person can watch an automated session as if it were live, replacing any prior one. Each chunk is
+// written exactly once as it is read, before filters and regardless of when or how often it is
+// matched, and unmodified (including any terminal escape sequences). It is written before any output
+// sinks and errors are ignored. A nil writer disables mirroring
+func (s *Shell) SetMirror(w io.Writer) {
+	s.hookLock.Lock()
+	s.param.mirror = w
+	s.hookLock.Unlock()
+}
+
+// writeSinks writes a chunk of received data to the mirror and all the output sinks
+func (s *Shell) writeSinks(b []byte) {
+	s.hookLock.RLock()
+	mirror, sinks := s.param.mirror, s.param.sinks
+	s.hookLock.RUnlock()
+
+	if mirror != nil {
+		mirror.Write(b)
+	}
+	for _, sink := range sinks {
+		// Errors are deliberately ignored so a single bad sink can't break the others
+		sink.Write(b)
+	}
+}
@@ -0,0 +1,83 @@
+package cliexpect_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+type syncBuilder struct {
+	lock sync.Mutex
+	b    strings.Builder
+}
+
+func (s *syncBuilder) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.b.Write(b)
+}
+
+func (s *syncBuilder) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.b.String()
+}
+
+type errWriter struct{}
+
+func (w errWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("Bad write")
+}
+
+func TestOutputSinks(t *testing.T) {
+	r, w := io.Pipe()
+	sh := cliexpect.New(new(writer), r)
+	sh.SetPromptRegex(`\S+#`)
+	sink1, sink2 := new(syncBuilder), new(syncBuilder)
+	sh.AddOutputSink(sink1)
+	sh.AddOutputSink(errWriter{})
+	sh.AddOutputSink(sink2)
+
+	go w.Write([]byte("one\nrouter#"))
+	_, _, err := sh.Retrieve()
+	assert.NoError(t, err)
+
+	sh.RemoveOutputSink(sink1)
+	go w.Write([]byte("two\nrouter#"))
+	_, _, err = sh.Retrieve()
+	assert.NoError(t, err)
+
+	// Sinks are always written before the data is buffered
+	assert.Equal(t, "one\nrouter#", sink1.String())
+	assert.Equal(t, "one\nrouter#two\nrouter#", sink2.String())
+}
+
+func TestSetMirror(t *testing.T) {
+	r, w := io.Pipe()
+	sh := cliexpect.New(new(writer), r)
+	sh.SetPromptRegex(`\S+#`)
+	sh.AddFilter(cliexpect.StripANSI)
+	mirror := new(syncBuilder)
+	sh.SetMirror(mirror)
+
+	// Partial data is matched more than once, but only mirrored once
+	go func() {
+		w.Write([]byte("\x1b[1mone\x1b[0m\n"))
+		w.Write([]byte("two\nrouter#"))
+	}()
+	_, groups, err := sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one\ntwo\n", "router#"}, groups)
+
+	sh.SetMirror(nil)
+	go w.Write([]byte("three\nrouter#"))
+	_, _, err = sh.Retrieve()
+	assert.NoError(t, err)
+
+	assert.Equal(t, "\x1b[1mone\x1b[0m\ntwo\nrouter#", mirror.String())
+}
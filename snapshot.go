@@ -0,0 +1,34 @@
+package cliexpect
+
+// Snapshot is an immutable record of the output state of a shell at one point in time, used to
+// detect whether anything changed since. It captures the data buffered but not yet consumed, the
+// total number of bytes ever received and whether the end of the stream was reached, so output that
+// arrived and was consumed in between is still seen as a change
+type Snapshot struct {
+	buffered string
+	received int
+	eof      bool
+}
+
+// Buffered returns the data that was buffered but not yet consumed when the snapshot was taken
+func (sn Snapshot) Buffered() string {
+	return sn.buffered
+}
+
+// Equal returns true if nothing was received, consumed or closed between the two snapshots
+func (sn Snapshot) Equal(other Snapshot) bool {
+	return sn == other
+}
+
+// Snapshot returns a Snapshot of the current output state without consuming anything
+func (s *Shell) Snapshot() Snapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return Snapshot{buffered: s.bufferString(), received: s.received, eof: s.eof}
+}
+
+// HasChangedSince returns true if the output state differs from the one captured by sn, for polling
+// until the output settles
+func (s *Shell) HasChangedSince(sn Snapshot) bool {
+	return !s.Snapshot().Equal(sn)
+}
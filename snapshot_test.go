@@ -0,0 +1,38 @@
+package cliexpect_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	sh := cliexpect.New(new(writer), new(blockingReader))
+	sh.SetPromptRegex(`\S+#`)
+
+	sh.FeedForTest("\nbooting")
+	snap := sh.Snapshot()
+	assert.Equal(t, "\nbooting", snap.Buffered())
+	assert.False(t, sh.HasChangedSince(snap))
+	assert.True(t, sh.Snapshot().Equal(snap))
+
+	sh.FeedForTest("...")
+	assert.True(t, sh.HasChangedSince(snap))
+
+	// The same data buffered again after consuming is still a change
+	sh.FeedForTest("\nrouter#")
+	snap = sh.Snapshot()
+	_, err := sh.ReadAvailable()
+	assert.NoError(t, err)
+	sh.FeedForTest("\nbooting...\nrouter#")
+	assert.Equal(t, snap.Buffered(), sh.Snapshot().Buffered())
+	assert.True(t, sh.HasChangedSince(snap))
+
+	_, _, err = sh.Retrieve()
+	assert.NoError(t, err)
+	snap = sh.Snapshot()
+	time.Sleep(time.Millisecond)
+	assert.False(t, sh.HasChangedSince(snap))
+}
@@ -0,0 +1,115 @@
+package cliexpect
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoStderr is returned by ExpectStderr when no stderr reader has been attached
+var ErrNoStderr = errors.New("No stderr attached")
+
+// stderrStream is the buffer of a second stream read independently of the shell's main Reader
+type stderrStream struct {
+	in     io.Reader
+	lock   sync.Mutex
+	buffer strings.Builder
+	err    error         // First read error, after which nothing more is read
+	notify chan struct{} // Signaled (without blocking) after each read
+}
+
+// read loops reading the stream into its buffer until the first error
+func (st *stderrStream) read() {
+	buff := make([]byte, readBuffSize)
+	for {
+		n, err := st.in.Read(buff)
+		st.lock.Lock()
+		st.buffer.Write(buff[:n])
+		st.err = err
+		st.lock.Unlock()
+
+		select {
+		case st.notify <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// AttachStderr reads r in its own goroutine into a buffer separate from the shell's main one, such as
+// the stderr of a command whose prompt is on stdout, so ExpectStderr can match against it without
+// the two streams being conflated. It can only be attached once. Close closes r if it is an
+// io.Closer. None of the other operations are affected
+func (s *Shell) AttachStderr(r io.Reader) error {
+	st := &stderrStream{in: r, notify: make(chan struct{}, 1)}
+	s.lock.Lock()
+	if s.stderr != nil {
+		s.lock.Unlock()
+		return errors.New("Stderr already attached")
+	}
+	s.stderr = st
+	s.lock.Unlock()
+
+	go st.read()
+	return nil
+}
+
+// ExpectStderr waits for m to match the data buffered from the reader attached with AttachStderr,
+// consuming everything through the match. There are no prompts on this stream, so the first return
+// value is all the data consumed, and the match groups are returned just like those of Expect
+// (without a prompt). ErrNoMatches is returned once the stream ends without a match
+func (s *Shell) ExpectStderr(m Matcher) (string, []string, error) {
+	s.lock.Lock()
+	st, failed := s.stderr, s.failed
+	s.lock.Unlock()
+	if failed != nil {
+		return "", nil, failed
+	}
+	if st == nil {
+		return "", nil, ErrNoStderr
+	}
+
+	timer := time.NewTimer(s.timeout())
+	defer timer.Stop()
+	for {
+		st.lock.Lock()
+		data, err := st.buffer.String(), st.err
+		if result := m(data); len(result) >= 2 {
+			st.buffer.Reset()
+			st.buffer.WriteString(data[result[1]:])
+			st.lock.Unlock()
+			return data[:result[1]], processResults(result, data), nil
+		}
+		st.lock.Unlock()
+
+		if err != nil {
+			if err == io.EOF {
+				err = ErrNoMatches
+			}
+			return "", nil, err
+		}
+		select {
+		case <-st.notify:
+		case <-timer.C:
+			return "", nil, errTimeout
+		}
+	}
+}
+
+// closeStderr closes the attached stderr reader, if any, if it is an io.Closer
+func (s *Shell) closeStderr() error {
+	s.lock.Lock()
+	st := s.stderr
+	s.lock.Unlock()
+	if st == nil {
+		return nil
+	}
+	if closer, ok := st.in.(io.Closer); ok && !sameValue(st.in, s.out) {
+		return closer.Close()
+	}
+	return nil
+}
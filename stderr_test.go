@@ -0,0 +1,43 @@
+package cliexpect_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpectStderr(t *testing.T) {
+	param := cliexpect.ShellParam{Timeout: 10 * time.Millisecond}
+	sh := cliexpect.NewWithParam(new(writer), &blockingReader{data: "ok\nrouter#"}, param)
+	sh.SetPromptRegex(`\S+#`)
+
+	_, _, err := sh.ExpectStderr(cliexpect.StrMatcher("error"))
+	assert.Equal(t, cliexpect.ErrNoStderr, err)
+
+	r, w := io.Pipe()
+	assert.NoError(t, sh.AttachStderr(r))
+	assert.Error(t, sh.AttachStderr(strings.NewReader("")))
+	go w.Write([]byte("warning: disk\nerror: bad thing\n"))
+
+	full, groups, err := sh.ExpectStderr(cliexpect.RegexMatcher(`error: ([^\n]*)`))
+	assert.NoError(t, err)
+	assert.Equal(t, "warning: disk\nerror: bad thing", full)
+	assert.Equal(t, []string{"error: bad thing", "bad thing"}, groups)
+
+	// The main stream is unaffected
+	_, groups, err = sh.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ok\n", "router#"}, groups)
+
+	// Times out while the stream is open, then fails once it ends
+	_, _, err = sh.ExpectStderr(cliexpect.StrMatcher("error"))
+	assert.Error(t, err)
+	w.Close()
+	_, _, err = sh.ExpectStderr(cliexpect.StrMatcher("error"))
+	assert.Equal(t, cliexpect.ErrNoMatches, err)
+	assert.NoError(t, sh.Close())
+}
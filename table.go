@@ -0,0 +1,103 @@
+package cliexpect
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TableMatcher matches a column structured table beginning with a header line matching the header
+// regex (anchored to the start of a line) through all the following rows up to a blank line or the
+// end of the input (which for Expect is the prompt)
+func TableMatcher(header string) Matcher {
+	re := regexp.MustCompile(matchFmt + `^(?:` + header + `).*?$`)
+
+	return func(input string) []int {
+		loc := re.FindStringIndex(input)
+		if loc == nil {
+			return nil
+		}
+		// End is always either the end of input or the newline ending the last line in the table
+		end := loc[1]
+		for end < len(input) {
+			line := input[end+1:]
+			if idx := strings.IndexByte(line, '\n'); idx >= 0 {
+				line = line[:idx]
+			}
+			if strings.TrimSpace(line) == "" {
+				break
+			}
+			end += 1 + len(line)
+		}
+		return []int{loc[0], end}
+	}
+}
+
+// ExpectTable works like Expect using a TableMatcher and then parses the table returning the header
+// columns as the first row followed by one row per data line. Columns are split on whitespace when
+// a row has exactly as many fields as the header, otherwise the text under each header column is
+// used so cells may contain spaces. A line starting with whitespace with an empty first cell is
+// treated as a wrapped continuation of the row before it and its cells are appended to that row
+func (s *Shell) ExpectTable(header string) ([][]string, error) {
+	_, groups, err := s.Expect(TableMatcher(header))
+	if groups == nil {
+		return nil, err
+	}
+	return parseTable(groups[0]), err
+}
+
+// parseTable parses the text of a table matched by TableMatcher into rows of cells
+func parseTable(text string) [][]string {
+	lines := strings.Split(strings.Replace(text, "\r", "", -1), "\n")
+	rows := [][]string{strings.Fields(lines[0])}
+	starts := columnStarts(lines[0])
+
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		wrapped := line[0] == ' ' || line[0] == '\t'
+		fields := strings.Fields(line)
+		if len(fields) != len(starts) || wrapped {
+			fields = splitColumns(line, starts)
+		}
+
+		if wrapped && fields[0] == "" && len(rows) > 1 {
+			last := rows[len(rows)-1]
+			for i, field := range fields {
+				if field != "" {
+					last[i] = strings.TrimSpace(last[i] + " " + field)
+				}
+			}
+			continue
+		}
+		rows = append(rows, fields)
+	}
+	return rows
+}
+
+// columnStarts returns the index of the start of each whitespace separated field in the header
+func columnStarts(header string) []int {
+	var starts []int
+	for i := 0; i < len(header); i++ {
+		if header[i] != ' ' && header[i] != '\t' && (i == 0 || header[i-1] == ' ' || header[i-1] == '\t') {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+// splitColumns splits a line into cells using the text positioned under each header column
+func splitColumns(line string, starts []int) []string {
+	cells := make([]string, len(starts))
+	for i, start := range starts {
+		if start >= len(line) {
+			break
+		}
+		end := len(line)
+		if i+1 < len(starts) && starts[i+1] < end {
+			end = starts[i+1]
+		}
+		cells[i] = strings.TrimSpace(line[start:end])
+	}
+	return cells
+}
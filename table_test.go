@@ -0,0 +1,36 @@
+package cliexpect_test
+
+import (
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+const table = `show interfaces
+Interface   Status  Description
+eth0        up      Uplink to
+                    core
+eth1        down    Spare
+
+Total: 2
+`
+
+func TestTableMatcher(t *testing.T) {
+	m := cliexpect.TableMatcher(`Interface\s+Status`)
+	assert.Equal(t, []int{16, 128}, m(table))
+	assert.Nil(t, m("no table here"))
+}
+
+func TestExpectTable(t *testing.T) {
+	sh := cliexpect.New(new(writer), &blockingReader{data: table + "router#"})
+	sh.SetPromptRegex(`\S+#`)
+
+	rows, err := sh.ExpectTable(`Interface\s+Status`)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"Interface", "Status", "Description"},
+		{"eth0", "up", "Uplink to core"},
+		{"eth1", "down", "Spare"},
+	}, rows)
+}
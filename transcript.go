@@ -0,0 +1,74 @@
+package cliexpect
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Diff represents a single line that differs between a recorded and an actual transcript. The line
+// numbers are one-based and only set along with the matching Has field: a line only one side has
+// (because it was added or removed) has just that side, and a changed line has both
+type Diff struct {
+	RecordedLine, ActualLine int
+	Recorded, Actual         string
+	HasRecorded, HasActual   bool
+}
+
+// Compare reads two line oriented session transcripts and returns every line that differs after
+// both sides have been passed through normalize (which may be nil). The normalizer is typically
+// used to mask volatile fields such as timestamps before comparing. The lines are aligned just like
+// ExpectTemplate, so one added or removed line is reported on its own instead of shifting every
+// line after it
+func Compare(recorded, actual io.Reader, normalize func(string) string) ([]Diff, error) {
+	if normalize == nil {
+		normalize = func(line string) string { return line }
+	}
+	recLines, err := readLines(recorded, normalize)
+	if err != nil {
+		return nil, err
+	}
+	actLines, err := readLines(actual, normalize)
+	if err != nil {
+		return nil, err
+	}
+
+	lineDiffs := diffLines(recLines, actLines, func(i, j int) bool { return recLines[i] == actLines[j] })
+	var diffs []Diff
+	for _, d := range lineDiffs {
+		diffs = append(diffs, Diff{RecordedLine: d.TemplateLine, ActualLine: d.BodyLine,
+			Recorded: d.Template, Actual: d.Body, HasRecorded: d.Kind != DiffExtra, HasActual: d.Kind != DiffMissing})
+	}
+	return diffs, nil
+}
+
+// readLines reads all the lines from r, without their line endings, passing each through normalize.
+// Unlike a bufio.Scanner, lines can be of any length
+func readLines(r io.Reader, normalize func(string) string) ([]string, error) {
+	var lines []string
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			lines = append(lines, normalize(line))
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+// RegexNormalizer returns a normalizer for Compare that replaces every match of the regex with repl
+// (which may contain regexp expansion references such as $1)
+func RegexNormalizer(regex, repl string) func(string) string {
+	re := regexp.MustCompile(regex)
+
+	return func(line string) string {
+		return re.ReplaceAllString(line, repl)
+	}
+}
@@ -0,0 +1,55 @@
+package cliexpect_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	recorded := "12:00:01 show clock\nup 5 days\nrouter#"
+	actual := "13:45:10 show clock\nup 6 days\nrouter#\nextra"
+	normalize := cliexpect.RegexNormalizer(`\d\d:\d\d:\d\d`, "<time>")
+
+	diffs, err := cliexpect.Compare(strings.NewReader(recorded), strings.NewReader(actual), normalize)
+	assert.NoError(t, err)
+	assert.Equal(t, []cliexpect.Diff{
+		{RecordedLine: 2, ActualLine: 2, Recorded: "up 5 days", Actual: "up 6 days", HasRecorded: true,
+			HasActual: true},
+		{ActualLine: 4, Actual: "extra", HasActual: true},
+	}, diffs)
+}
+
+func TestCompareInserted(t *testing.T) {
+	recorded := "show clock\nup 5 days\nrouter#\n"
+	actual := "show clock\n%Warning: unsaved config\nup 5 days\nrouter#\n"
+
+	// Only the inserted line differs, not every line after it
+	diffs, err := cliexpect.Compare(strings.NewReader(recorded), strings.NewReader(actual), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []cliexpect.Diff{{ActualLine: 2, Actual: "%Warning: unsaved config", HasActual: true}}, diffs)
+
+	diffs, err = cliexpect.Compare(strings.NewReader(actual), strings.NewReader(recorded), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []cliexpect.Diff{{RecordedLine: 2, Recorded: "%Warning: unsaved config", HasRecorded: true}}, diffs)
+}
+
+func TestCompareLongLine(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	recorded, actual := "show run\r\n"+long+"\r\nrouter#", "show run\n"+long+"y\nrouter#"
+
+	diffs, err := cliexpect.Compare(strings.NewReader(recorded), strings.NewReader(actual), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []cliexpect.Diff{{RecordedLine: 2, ActualLine: 2, Recorded: long, Actual: long + "y",
+		HasRecorded: true, HasActual: true}}, diffs)
+}
+
+func TestCompareIdentical(t *testing.T) {
+	data := "show clock\nrouter#"
+
+	diffs, err := cliexpect.Compare(strings.NewReader(data), strings.NewReader(data), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+}
@@ -0,0 +1,85 @@
+package cliexpect
+
+// unwrapper rejoins lines a device wrapped at the terminal width as data streams through the reader.
+// It keeps its state between reads so wraps split across reads are still rejoined
+type unwrapper struct {
+	col       int  // Visible columns since the last line break
+	esc       int  // Position within an escape sequence: zero (none), escStart, or escCSI
+	pendingCR bool // A "\r" at the terminal width that may start a wrap "\r\n"
+}
+
+const (
+	escStart = iota + 1
+	escCSI
+)
+
+// SetTerminalWidth enables rejoining lines the device wrapped at cols columns (such as when it honors
+// the PTY window size) so multi-line regexes aren't broken by artificial line breaks. Any line break
+// ("\n" or "\r\n") that comes when exactly cols columns have been output since the last one is
+// removed. ANSI escape sequences take no columns, and each UTF-8 character takes one (wide
+// characters and tabs aren't accounted for). NOTE: There is no way to tell an artificial line break
+// from a real one after a line that happens to be exactly cols wide, and that line will be joined to
+// the next as well. It applies to data read from then on, before any filters. Zero disables it
+func (s *Shell) SetTerminalWidth(cols int) {
+	s.hookLock.Lock()
+	s.param.termWidth = cols
+	s.hookLock.Unlock()
+}
+
+// unwrapLines removes the wrapping line breaks from chunk. If final, no more data will be read so any
+// held back "\r" is restored
+func (s *Shell) unwrapLines(chunk []byte, final bool) []byte {
+	s.hookLock.RLock()
+	cols := s.param.termWidth
+	s.hookLock.RUnlock()
+
+	u := &s.unwrap
+	if cols < 1 && !u.pendingCR {
+		return chunk
+	}
+	out := make([]byte, 0, len(chunk)+1)
+	for _, c := range chunk {
+		if u.pendingCR {
+			u.pendingCR = false
+			u.col = 0
+			if c == '\n' {
+				continue // Drop the whole wrap "\r\n"
+			}
+			out = append(out, '\r')
+		}
+
+		switch {
+		case u.esc == escStart:
+			u.esc = 0
+			if c == '[' {
+				u.esc = escCSI
+			}
+		case u.esc == escCSI:
+			if c >= 0x40 && c <= 0x7e {
+				u.esc = 0
+			}
+		case c == 0x1b:
+			u.esc = escStart
+		case c == '\n':
+			wrapped := u.col == cols
+			u.col = 0
+			if wrapped {
+				continue
+			}
+		case c == '\r':
+			if u.col == cols {
+				u.pendingCR = true
+				continue
+			}
+			u.col = 0
+		case c >= 0x20 && c&0xc0 != 0x80: // Printable, but not a UTF-8 continuation byte
+			u.col++
+		}
+		out = append(out, c)
+	}
+	if final && u.pendingCR {
+		u.pendingCR = false
+		out = append(out, '\r')
+	}
+	return out
+}
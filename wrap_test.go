@@ -0,0 +1,41 @@
+package cliexpect_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/nu11ptr/cliexpect"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetTerminalWidth(t *testing.T) {
+	tests := []struct {
+		name, data, body string
+	}{
+		{"Wrapped", "abcde\nfghij\nkl\n", "abcdefghijkl\n"},
+		{"WrappedCRLF", "abcde\r\nfg\r\n", "abcdefg\r\n"},
+		{"ShortLines", "abc\nde\r\n", "abc\nde\r\n"},
+		{"ANSI", "\x1b[1mabc\x1b[0mde\nf\n", "\x1b[1mabc\x1b[0mdef\n"},
+		{"Unicode", "abcdé\nf\n", "abcdéf\n"},
+		{"CarriageReturn", "abc\rabcde\nf\n", "abc\rabcdef\n"},
+		{"CRNotWrap", "abcde\rxy\n", "abcde\rxy\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, w := io.Pipe()
+			sh := cliexpect.New(new(writer), r)
+			sh.SetPromptRegex(`\S+#`)
+			sh.SetTerminalWidth(5)
+
+			// One byte at a time, so every wrap is split across reads
+			go func() {
+				for _, b := range []byte(test.data + "r#") {
+					w.Write([]byte{b})
+				}
+			}()
+			_, groups, err := sh.Retrieve()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{test.body, "r#"}, groups)
+		})
+	}
+}